@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  Read policies. What a caller may read of a device depends on its party, the MSP id it signs with:
+//    VENDOR     the devices its party created, and every device created before parties
+//    WAREHOUSE  the devices its party holds and those shipped or returned to it
+//    STORE      its party's stock, the devices shipped to it and the devices it sold to customers
+//    CUSTOMER   only the devices sold to it, checked against the customer_hash of its username
+//  Records written before parties only name the holder's role, which any party of that role may
+//  read. A supply chain party asking for a device outside its policy is given a DeviceSummary;
+//  list queries only return the devices the caller may read in full.
+//=================================================================================================
+
+const (
+	VIEW_NONE    = "none"
+	VIEW_SUMMARY = "summary"
+	VIEW_FULL    = "full"
+)
+
+//=================================================================================================
+//  DeviceSummary -- the redacted view of a device: what it is and whether it can be handled, but
+//  not where it is, who holds it or when it moved
+//=================================================================================================
+
+type DeviceSummary struct {
+	IMEI        string `json:"imei"`
+	DeviceName  string `json:"devicename"`
+	DeviceModel string `json:"devicemodel"`
+	Status      string `json:"status"`
+	Refurbished bool   `json:"refurbished,omitempty"`
+	Blacklisted string `json:"blacklisted,omitempty"`
+	Redacted    bool   `json:"redacted"`
+}
+
+func summarize(d Device) DeviceSummary {
+	return DeviceSummary{IMEI: d.IMEI, DeviceName: d.DeviceName, DeviceModel: d.DeviceModel, Status: d.Status,
+		Refurbished: d.Refurbished, Blacklisted: d.Blacklisted, Redacted: true}
+}
+
+//=================================================================================================
+//  Reader -- the caller a query runs for. username is only read for customers.
+//=================================================================================================
+
+type Reader struct {
+	Affiliation string
+	Party       string
+	username    string
+	secret      []byte
+}
+
+func (t *SimpleChainCode) get_reader(stub shim.ChaincodeStubInterface, callerAffiliation string) (Reader, error) {
+
+	party, err := t.get_party(stub)
+
+	if err != nil { return Reader{}, err }
+
+	r := Reader{Affiliation: callerAffiliation, Party: party}
+
+	if callerAffiliation != CUSTOMER { return r, nil }
+
+	username, err := t.get_username(stub)
+
+	if err != nil { return r, permission_denied("Error retrieving caller information") }
+
+	r.username = username
+
+	r.secret, err = t.get_customer_secret(stub)
+
+	if err != nil { return r, err }
+
+	return r, nil
+}
+
+//=================================================================================================
+//  view -- how much of a device the reader may see
+//=================================================================================================
+
+func (r Reader) view(d Device) string {
+
+	switch r.Affiliation {
+	case VENDOR:
+		if d.CreatedBy == "" || d.CreatedBy == r.Party { return VIEW_FULL }
+	case CUSTOMER:
+		if d.Owner == CUSTOMER && owned_by(r.secret, d.IMEI, d.OwnerID, r.username) { return VIEW_FULL }
+		return VIEW_NONE
+	case STORE:
+		if d.SellingStore == r.Party || (d.SellingStore == "" && d.Owner == CUSTOMER && !d.DateOfSale.IsZero()) { return VIEW_FULL }
+	}
+
+	if in_custody(d, r.Affiliation, r.Party) { return VIEW_FULL }
+
+	return VIEW_SUMMARY
+}
+
+//=================================================================================================
+//  get_dev_details -- returns a device as the reader may see it
+//=================================================================================================
+
+func (t *SimpleChainCode) get_dev_details(r Reader, device Device) ([]byte, error) {
+
+	var bytes []byte
+	var err error
+
+	switch r.view(device) {
+	case VIEW_FULL:
+		bytes, err = json.Marshal(device)
+	case VIEW_SUMMARY:
+		bytes, err = json.Marshal(summarize(device))
+	default:
+		return nil, permission_denied("Device %s does not belong to the caller", device.IMEI)
+	}
+
+	if err != nil { return nil, errors.New("Invalid device object") }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  read_device -- retrieves a device for a query about it, with how much of it the reader may see.
+//  A caller who may see nothing of the device is refused.
+//=================================================================================================
+
+func (t *SimpleChainCode) read_device(stub shim.ChaincodeStubInterface, r Reader, imei string) (Device, string, error) {
+
+	dev, err := t.get_device(stub, imei)
+
+	if err != nil { return dev, VIEW_NONE, err }
+
+	view := r.view(dev)
+
+	if view == VIEW_NONE { return dev, view, permission_denied("Device %s does not belong to the caller", dev.IMEI) }
+
+	return dev, view, nil
+}
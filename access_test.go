@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func (l *test_ledger) visible(filter string) []string {
+	l.t.Helper()
+	var page DevicePage
+	if err := json.Unmarshal([]byte(l.must("get_devices", filter)), &page); err != nil { l.t.Fatal(err) }
+	imeis := []string{}
+	for _, d := range page.Devices { imeis = append(imeis, d.IMEI) }
+	if page.More || page.Count != len(imeis) || page.Bookmark != "" { l.t.Errorf("page %+v", page) }
+	return imeis
+}
+
+func TestReadPolicies(t *testing.T) {
+
+	l := new_test_ledger(t)
+	held, shipped, stock, mine, theirs := l.create(1), l.create(2), l.create(3), l.create(4), l.create(5)
+	l.run_steps(to_vendor_and_back[:2], held)
+	l.run_steps(to_vendor_and_back[:1], shipped)
+	l.run_steps(to_vendor_and_back[:4], stock)
+	l.run_steps(to_vendor_and_back[:4], mine)
+	l.run_steps(to_vendor_and_back[:4], theirs)
+	l.as(STORE).selling(STORE, "customer").must("TRF_TO_CUST", mine)
+	l.selling(STORE, "cust-42").must("TRF_TO_CUST", theirs)
+
+	for _, c := range []struct{ Role, Expected string }{
+		{VENDOR, strings.Join([]string{held, shipped, stock, mine, theirs}, ",")},
+		{WAREHOUSE, strings.Join([]string{held, shipped}, ",")},
+		{STORE, strings.Join([]string{stock, mine, theirs}, ",")},
+		{CUSTOMER, mine},
+	} {
+		if got := strings.Join(l.as(c.Role).visible(""), ","); got != c.Expected { t.Errorf("%s sees %s, expected %s", c.Role, got, c.Expected) }
+	}
+
+	// outside its policy a supply chain party gets the summary, a customer nothing
+	out := l.as(WAREHOUSE).must("get_device_details", stock)
+	var summary map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &summary); err != nil { t.Fatal(err) }
+	if summary["redacted"] != true || summary["status"] != STATUS_RECEIVED || summary["owner"] != nil || summary["dateofreceipt"] != nil { t.Errorf("summary %s", out) }
+
+	l.as_user(CUSTOMER, "customer", WAREHOUSE).fails(ERR_PERMISSION_DENIED, "get_device_details", mine)
+	if d := l.as(CUSTOMER).must("get_device_details", mine); strings.Contains(d, `"redacted"`) || !strings.Contains(d, `"ownerid"`) { t.Errorf("own device %s", d) }
+	l.fails(ERR_PERMISSION_DENIED, "get_device_details", theirs)
+	l.fails(ERR_PERMISSION_DENIED, "get_device_details", stock)
+
+	var devices []Device
+	if err := json.Unmarshal([]byte(l.must("get_devices_by_status", STATUS_DELIVERED_TO_CUSTOMER)), &devices); err != nil { t.Fatal(err) }
+	if len(devices) != 1 || devices[0].IMEI != mine { t.Errorf("customer lists %+v", devices) }
+	if err := json.Unmarshal([]byte(l.as(WAREHOUSE).must("get_devices_by_owner", STORE)), &devices); err != nil || len(devices) != 0 { t.Errorf("warehouse lists %+v", devices) }
+
+	// the policies follow the party, not only its role
+	for _, c := range []struct{ Role, Party, Expected string }{
+		{VENDOR, "VENDOR2", ""},
+		{WAREHOUSE, "WH2", ""},
+		{STORE, "STORE2", ""},
+	} {
+		if got := strings.Join(l.as_party(c.Role, c.Party).visible(""), ","); got != c.Expected { t.Errorf("%s sees %s, expected %s", c.Party, got, c.Expected) }
+	}
+
+	if d := l.as_party(STORE, "STORE2").must("get_device_details", theirs); !strings.Contains(d, `"redacted":true`) { t.Errorf("device sold by another store %s", d) }
+	if d := l.as_party(WAREHOUSE, "WH2").must("get_device_details", shipped); !strings.Contains(d, `"redacted":true`) { t.Errorf("device shipped to another warehouse %s", d) }
+	if d := l.as(WAREHOUSE).must("get_device_details", shipped); strings.Contains(d, `"redacted"`) { t.Errorf("device shipped to the warehouse %s", d) }
+	l.as_party(STORE, "STORE2").fails(ERR_PERMISSION_DENIED, "get_sale", theirs)
+	l.as(STORE).must("get_sale", theirs)
+}
+
+func TestRedactedRecords(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+	l.run_steps(to_vendor_and_back[:4], imei)
+	l.as(STORE).selling(STORE, "customer").must("TRF_TO_CUST", imei)
+
+	// the history, the warranty and the claims of a device follow its read policy
+	for _, c := range []struct{ Function string; Args []string; Private string }{
+		{"get_device_history", []string{imei}, `"txid"`},
+		{"check_warranty", []string{imei}, `"expires"`},
+	} {
+		if out := l.as(STORE).must(c.Function, c.Args...); strings.Contains(out, `"redacted"`) || !strings.Contains(out, c.Private) { t.Errorf("%s for the selling store %s", c.Function, out) }
+		out := l.as_party(STORE, "STORE2").must(c.Function, c.Args...)
+		if !strings.Contains(out, `"redacted":true`) || strings.Contains(out, c.Private) { t.Errorf("%s for another store %s", c.Function, out) }
+	}
+
+	if out := l.as(CUSTOMER).must("check_warranty", imei); strings.Contains(out, `"redacted"`) { t.Errorf("warranty for the owner %s", out) }
+	l.as_user(CUSTOMER, "other", CUSTOMER).fails(ERR_PERMISSION_DENIED, "get_device_history", imei)
+	l.fails(ERR_PERMISSION_DENIED, "get_warranty_claims", imei)
+	l.fails(ERR_PERMISSION_DENIED, "get_repairs", imei)
+
+	if out := l.as_party(WAREHOUSE, "WH2").must("get_warranty_claims", imei); out != "[]" { t.Errorf("claims %s", out) }
+
+	// a consignment is only shown in full to its origin and destination
+	l.as(VENDOR).must("DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", WAREHOUSE, `["`+l.create(2)+`"]`)
+
+	for _, c := range []struct{ Role, Party string; Full bool }{
+		{VENDOR, VENDOR, true},
+		{WAREHOUSE, WAREHOUSE, true},
+		{WAREHOUSE, "WH2", false},
+		{STORE, STORE, false},
+	} {
+		out := l.as_party(c.Role, c.Party).must("get_consignment", "S1")
+		if full := !strings.Contains(out, `"redacted"`) && strings.Contains(out, test_imei(2)); full != c.Full { t.Errorf("consignment for %s %s", c.Party, out) }
+	}
+
+	l.as(CUSTOMER).fails(ERR_PERMISSION_DENIED, "get_consignment", "S1")
+}
+
+func TestParties(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	// a role is only accepted from an MSP registered for it
+	l.as_party(VENDOR, STORE).fails(ERR_PERMISSION_DENIED, "register_tac", "35209900", "LENOVO", "VIBE")
+	l.as_party(VENDOR, "ROGUE").fails(ERR_PERMISSION_DENIED, "set_customer_secret")
+	l.as_party(STORE, "STORE3").fails(ERR_PERMISSION_DENIED, "get_devices", "")
+
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "register_party", "STORE3", STORE)
+	l.as(VENDOR).fails(ERR_VALIDATION_FAILED, "register_party", "STORE3", "SHOPPER")
+	l.must("register_party", "STORE3", STORE)
+	l.as_party(STORE, "STORE3").must("get_devices", "")
+
+	// customers only sign with an MSP registered for them
+	l.as_party(CUSTOMER, "ROGUE").fails(ERR_PERMISSION_DENIED, "get_devices", "")
+	l.as(VENDOR).must("register_party", "CUSTOMER2", CUSTOMER)
+	l.as_party(CUSTOMER, "CUSTOMER2").must("get_devices", "")
+}
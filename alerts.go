@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const ALERT_KEY = "alert"
+
+const (
+	ALERT_CLONE_SUSPECTED = "CLONE_SUSPECTED"
+	ALERT_SKIPPED_HOP     = "SKIPPED_HOP"
+	ALERT_TAC_MISMATCH    = "TAC_MISMATCH"
+)
+
+const (
+	ALERT_OPEN   = "OPEN"
+	ALERT_CLOSED = "CLOSED"
+)
+
+//=================================================================================================
+//  Alert -- an anomaly in the activity of an IMEI for the fraud team to look at. Alerts never
+//  stop the transaction that raised them:
+//    CLONE_SUSPECTED  the IMEI was seen somewhere other than where its custody chain puts it
+//    SKIPPED_HOP      a custody event does not start in the status the previous one ended in
+//    TAC_MISMATCH     the device's make and model are not the ones its TAC is registered to
+//  A device has at most one open alert of each type.
+//=================================================================================================
+
+type Alert struct {
+	ID         string     `json:"id"`
+	IMEI       string     `json:"imei"`
+	Type       string     `json:"type"`
+	Details    string     `json:"details"`
+	RaisedBy   string     `json:"raisedby"`
+	RaisedAt   LedgerTime `json:"raisedat"`
+	Status     string     `json:"status"`
+	Resolution string     `json:"resolution,omitempty"`
+	ClosedAt   LedgerTime `json:"closedat"`
+}
+
+func alert_key(stub shim.ChaincodeStubInterface, imei string, id string) (string, error) {
+	return create_composite_key(stub, ALERT_KEY, imei, id)
+}
+
+func (t *SimpleChainCode) save_alert(stub shim.ChaincodeStubInterface, a Alert) error {
+
+	bytes, err := json.Marshal(a)
+
+	if err != nil { return errors.New("Error converting alert") }
+
+	key, err := alert_key(stub, a.IMEI, a.ID)
+
+	if err != nil { return err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("SAVE_ALERT: Error storing alert %s: %s", a.ID, err); return errors.New("Error storing alert") }
+
+	return nil
+}
+
+//=================================================================================================
+//  list_alerts -- the alerts of one IMEI, or of every IMEI when imei is empty
+//=================================================================================================
+
+func (t *SimpleChainCode) list_alerts(stub shim.ChaincodeStubInterface, imei string) ([]Alert, error) {
+
+	alerts := []Alert{}
+
+	var attributes []string
+	if imei != "" { attributes = []string{imei} }
+
+	err := t.for_each_partial_key(stub, ALERT_KEY, attributes, func(key string, value []byte) (bool, error) {
+
+		var a Alert
+
+		err := json.Unmarshal(value, &a)
+
+		if err != nil { return false, errors.New("Corrupt alert " + key) }
+
+		alerts = append(alerts, a)
+		return true, nil
+	})
+
+	return alerts, err
+}
+
+//=================================================================================================
+//  raise_alert -- records an anomaly found by function, unless the device already has an open
+//  alert of the same type. Reports whether an alert was stored.
+//=================================================================================================
+
+func (t *SimpleChainCode) raise_alert(stub shim.ChaincodeStubInterface, imei string, alertType string, function string, details string) (bool, error) {
+
+	existing, err := t.list_alerts(stub, imei)
+
+	if err != nil { return false, err }
+
+	for _, a := range existing {
+		if a.Type == alertType && a.Status == ALERT_OPEN { return false, nil }
+	}
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return false, err }
+
+	a := Alert{ID: stub.GetTxID() + "." + alertType, IMEI: imei, Type: alertType, Details: details, RaisedBy: function,
+		RaisedAt: now, Status: ALERT_OPEN}
+
+	fmt.Printf("RAISE_ALERT: %s on %s: %s", alertType, imei, details)
+
+	return true, t.save_alert(stub, a)
+}
+
+//=================================================================================================
+//  in_custody -- whether the custody chain puts a device with the caller: its owner and, while it
+//  is shipped, the party it is ShippedTo. Records written before parties only know the owner's
+//  role, so any party of that role, or of the role that accepts the device on the way, holds it.
+//  A customer's device is with no supply chain party.
+//=================================================================================================
+
+func in_custody(dev Device, callerAffiliation string, party string) bool {
+
+	if dev.Owner == CUSTOMER || callerAffiliation == CUSTOMER { return false }
+
+	if dev.OwnerID != "" { return party == dev.OwnerID || (dev.ShippedTo != "" && party == dev.ShippedTo) }
+
+	if callerAffiliation == dev.Owner { return true }
+
+	for _, tr := range lifecycle {
+		if tr.From == dev.Status && tr.Owner == dev.Owner && tr.Caller == callerAffiliation { return true }
+	}
+
+	return false
+}
+
+//=================================================================================================
+//  check_sighting -- raises CLONE_SUSPECTED when the caller has the device in hand although its
+//  custody chain puts it elsewhere. A customer's device is only where a store names its customer.
+//=================================================================================================
+
+func (t *SimpleChainCode) check_sighting(stub shim.ChaincodeStubInterface, function string, dev Device, callerAffiliation string, party string, customer string) (bool, error) {
+
+	if in_custody(dev, callerAffiliation, party) { return false, nil }
+
+	if dev.Owner == CUSTOMER {
+		owned, err := t.is_customer(stub, dev.IMEI, dev.OwnerID, customer)
+		if err != nil { return false, err }
+		if owned { return false, nil }
+	}
+
+	return t.raise_alert(stub, dev.IMEI, ALERT_CLONE_SUSPECTED, function,
+		fmt.Sprintf("Seen at %s while %s owned by %s", party, strings.ToLower(dev.Status), dev.Owner))
+}
+
+//=================================================================================================
+//  check_hop -- raises SKIPPED_HOP when event does not continue from last, the event before it
+//=================================================================================================
+
+func (t *SimpleChainCode) check_hop(stub shim.ChaincodeStubInterface, last CustodyEvent, event CustodyEvent) (bool, error) {
+
+	if last.StatusAfter == event.StatusBefore { return false, nil }
+
+	return t.raise_alert(stub, event.IMEI, ALERT_SKIPPED_HOP, event.Function,
+		fmt.Sprintf("%s started in %s but %s left the device in %s", event.Function, event.StatusBefore, last.Function, last.StatusAfter))
+}
+
+//=================================================================================================
+//  check_device_tac -- raises TAC_MISMATCH when the device's TAC is registered to another model
+//=================================================================================================
+
+func (t *SimpleChainCode) check_device_tac(stub shim.ChaincodeStubInterface, function string, dev Device) (bool, error) {
+
+	info, err := parse_imei(dev.IMEI)
+
+	if err != nil { return false, nil }
+
+	err = t.check_tac(stub, info.TAC, dev.DeviceName, dev.DeviceModel)
+
+	if err == nil { return false, nil }
+
+	if as_chaincode_error(err).Code != ERR_VALIDATION_FAILED { return false, err }
+
+	return t.raise_alert(stub, dev.IMEI, ALERT_TAC_MISMATCH, function, error_message(err))
+}
+
+//=================================================================================================
+//  report_sighting -- records that the caller has a handset with this IMEI in hand, e.g. one
+//  offered as a trade-in; a store seeing a customer's device names the customer. Returns the
+//  device's blacklist status so the caller knows whether to accept it. An IMEISV is taken as the
+//  IMEI it contains.
+//=================================================================================================
+
+func (t *SimpleChainCode) report_sighting(stub shim.ChaincodeStubInterface, callerAffiliation string, imei string, customer string) ([]byte, error) {
+
+	if info, err := parse_imei(imei); err == nil { imei = info.IMEI }
+
+	party, err := t.get_party(stub)
+
+	if err != nil { return nil, err }
+
+	dev, err := t.get_device(stub, imei)
+
+	if err != nil { return nil, err }
+
+	_, err = t.check_sighting(stub, "report_sighting", dev, callerAffiliation, party, customer)
+
+	if err != nil { return nil, err }
+
+	return t.check_blacklist(stub, dev.IMEI)
+}
+
+//=================================================================================================
+//  scan_anomalies -- checks the custody chain and the TAC of every device, for records written
+//  before alerts existed or devices created before their TAC was registered. Returns the number
+//  of alerts raised.
+//=================================================================================================
+
+func (t *SimpleChainCode) scan_anomalies(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	count := 0
+
+	err := t.for_each_partial_key(stub, DEVICE_INDEX, nil, func(key string, value []byte) (bool, error) {
+
+		var dev Device
+
+		err := json.Unmarshal(value, &dev)
+
+		if err != nil { return false, errors.New("Unable to read device " + key) }
+
+		raised, err := t.check_device_tac(stub, "scan_anomalies", dev)
+
+		if err != nil { return false, err }
+		if raised { count++ }
+
+		history, err := t.get_history(stub, dev.IMEI)
+
+		if err != nil { return false, err }
+
+		for i := 1; i < len(history); i++ {
+			event := history[i]
+			event.Function = "scan_anomalies: " + event.Function
+			raised, err = t.check_hop(stub, history[i-1], event)
+			if err != nil { return false, err }
+			if raised { count++; break }
+		}
+
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	return []byte(fmt.Sprintf("%d", count)), nil
+}
+
+//=================================================================================================
+//  get_alerts -- lists alerts, of one IMEI when one is given, optionally only those in status
+//=================================================================================================
+
+func (t *SimpleChainCode) get_alerts(stub shim.ChaincodeStubInterface, imei string, status string) ([]byte, error) {
+
+	alerts, err := t.list_alerts(stub, imei)
+
+	if err != nil { return nil, err }
+
+	status = strings.ToUpper(strings.TrimSpace(status))
+
+	if status != "" && status != ALERT_OPEN && status != ALERT_CLOSED { return nil, validation_failed("Unknown alert status %s", status) }
+
+	selected := []Alert{}
+
+	for _, a := range alerts {
+		if status == "" || a.Status == status { selected = append(selected, a) }
+	}
+
+	return json.Marshal(selected)
+}
+
+//=================================================================================================
+//  close_alert -- records the outcome of the fraud team's investigation of an alert
+//=================================================================================================
+
+func (t *SimpleChainCode) close_alert(stub shim.ChaincodeStubInterface, imei string, id string, resolution string) ([]byte, error) {
+
+	var a Alert
+
+	key, err := alert_key(stub, imei, id)
+
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return nil, errors.New("Unable to get alert " + id) }
+
+	if bytes == nil { return nil, not_found("Unknown alert %s on device %s", id, imei) }
+
+	err = json.Unmarshal(bytes, &a)
+
+	if err != nil { return nil, errors.New("Corrupt alert " + id) }
+
+	if a.Status != ALERT_OPEN { return nil, validation_failed("Alert %s is already closed", id) }
+
+	if strings.TrimSpace(resolution) == "" { return nil, validation_failed("A resolution is required") }
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	a.Status = ALERT_CLOSED
+	a.Resolution = resolution
+	a.ClosedAt = now
+
+	err = t.save_alert(stub, a)
+
+	if err != nil { return nil, err }
+
+	return json.Marshal(a)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func (l *test_ledger) alerts(args ...string) []Alert {
+	l.t.Helper()
+	var alerts []Alert
+	if err := json.Unmarshal([]byte(l.as(VENDOR).must("get_alerts", args...)), &alerts); err != nil { l.t.Fatal(err) }
+	return alerts
+}
+
+func TestCheckUniqueIMEI(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+
+	if out := l.must("check_unique_imei", imei); out != "false" { t.Errorf("stored IMEI: %s", out) }
+	if out := l.must("check_unique_imei", imei[:14]+"07"); out != "false" { t.Errorf("IMEISV of a stored IMEI: %s", out) }
+	if out := l.must("check_unique_imei", test_imei(2)); out != "true" { t.Errorf("new IMEI: %s", out) }
+}
+
+func TestTACMismatchAlert(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+
+	// the TAC is registered after the device was created, to another model
+	l.must("register_tac", "35209900", "MOTOROLA", "G5")
+	l.run_steps(to_vendor_and_back[:2], imei)
+
+	alerts := l.alerts(imei)
+	if len(alerts) != 1 || alerts[0].Type != ALERT_TAC_MISMATCH || alerts[0].RaisedBy != "TRF_TO_WH" { t.Fatalf("alerts %+v", alerts) }
+
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "get_alerts", imei)
+	l.as(VENDOR).must("close_alert", imei, alerts[0].ID, "relabelled stock")
+	l.fails(ERR_VALIDATION_FAILED, "close_alert", imei, alerts[0].ID, "again")
+
+	if open := l.alerts(imei, ALERT_OPEN); len(open) != 0 { t.Errorf("open alerts %+v", open) }
+}
+
+func TestSkippedHopAlert(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei, legacy := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:1], imei)
+
+	// the device is moved to the store without going through the chaincode
+	d := l.device(imei)
+	d.Status, d.Owner, d.OwnerID = STATUS_RECEIVED, STORE, STORE
+	l.begin()
+	if _, err := l.cc.save_changes(l.stub, d); err != nil { t.Fatal(err) }
+	l.end()
+
+	l.as(STORE).selling(STORE, "cust-42").must("TRF_TO_CUST", imei)
+
+	if alerts := l.alerts(imei); len(alerts) != 1 || alerts[0].Type != ALERT_SKIPPED_HOP { t.Errorf("alerts %+v", alerts) }
+
+	// a gap already in the history is found by the scan
+	l.begin()
+	_, err := l.cc.put_events(l.stub, legacy, 0, []CustodyEvent{{IMEI: legacy, Function: "create_device", StatusAfter: STATUS_CREATED},
+		{IMEI: legacy, Function: "TRF_TO_CUST", StatusBefore: STATUS_RECEIVED, StatusAfter: STATUS_DELIVERED_TO_CUSTOMER}})
+	l.end()
+	if err != nil { t.Fatal(err) }
+
+	if out := l.as(VENDOR).must("scan_anomalies"); out != "1" { t.Errorf("scan raised %s alerts", out) }
+	if out := l.must("scan_anomalies"); out != "0" { t.Errorf("second scan raised %s alerts", out) }
+}
+
+func TestCloneAlert(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei, other := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:2], imei)
+	l.run_steps(to_vendor_and_back[:4], other)
+
+	l.as(WAREHOUSE).must("report_sighting", imei)
+	l.must("report_sighting", imei[:14]+"07")
+	if alerts := l.alerts(imei); len(alerts) != 0 { t.Errorf("sighting by the holder raised %+v", alerts) }
+
+	// custody is with the warehouse party holding the device, not with every warehouse
+	l.as_party(WAREHOUSE, "WH2").must("report_sighting", imei)
+	if alerts := l.alerts(imei); len(alerts) != 1 || alerts[0].Details != "Seen at WH2 while received owned by WAREHOUSE" { t.Fatalf("alerts %+v", alerts) }
+	l.as(VENDOR).must("close_alert", imei, l.alerts(imei)[0].ID, "checked")
+
+	var s BlacklistStatus
+	if err := json.Unmarshal([]byte(l.as(STORE).must("report_sighting", imei)), &s); err != nil || s.Blacklisted { t.Errorf("sighting answer %+v", s) }
+	if alerts := l.alerts(imei, ALERT_OPEN); len(alerts) != 1 || alerts[0].Type != ALERT_CLONE_SUSPECTED { t.Fatalf("alerts %+v", alerts) }
+
+	// a device the store holds turns up in a consignment to the warehouse
+	l.as(VENDOR).must("TRF_TO_WH", l.create(3), WAREHOUSE, "C9")
+	l.must("DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", WAREHOUSE, `["`+l.create(4)+`"]`)
+	l.as(WAREHOUSE).must("ACPT_CONSIGNMENT", "S1", `["`+test_imei(4)+`","`+other+`"]`)
+
+	if alerts := l.alerts(other); len(alerts) != 1 || alerts[0].RaisedBy != "ACPT_CONSIGNMENT" { t.Errorf("alerts %+v", alerts) }
+	if alerts := l.alerts("", ALERT_OPEN); len(alerts) != 2 { t.Errorf("open alerts %+v", alerts) }
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const MAX_BATCH_SIZE = 5000
+
+var manifest_columns = []string{"imei", "devicename", "devicemodel", "dateofmanf"}
+
+//=================================================================================================
+//  BatchReport -- the outcome of every manifest row. Rows are numbered from 1 in manifest order.
+//=================================================================================================
+
+type BatchRow struct {
+	Row    int    `json:"row"`
+	IMEI   string `json:"imei"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchReport struct {
+	Total    int        `json:"total"`
+	Created  int        `json:"created"`
+	Rejected int        `json:"rejected"`
+	Rows     []BatchRow `json:"rows"`
+}
+
+//=================================================================================================
+//  parse_manifest -- reads a manifest as a JSON array of DeviceSpec or as CSV with the columns
+//  imei, devicename, devicemodel, dateofmanf (the header line is optional). An empty format is
+//  detected from the first character of the manifest.
+//=================================================================================================
+
+func parse_manifest(manifest string, format string) ([]DeviceSpec, error) {
+
+	var specs []DeviceSpec
+
+	if format == "" {
+		format = "csv"
+		if strings.HasPrefix(strings.TrimSpace(manifest), "[") { format = "json" }
+	}
+
+	if format == "json" {
+		decoder := json.NewDecoder(strings.NewReader(manifest))
+		decoder.DisallowUnknownFields()
+
+		err := decoder.Decode(&specs)
+
+		if err != nil { return nil, validation_failed("Invalid JSON manifest: %s", err) }
+
+		return specs, nil
+	} else if format != "csv" {
+		return nil, validation_failed("Unknown manifest format %s", format)
+	}
+
+	reader := csv.NewReader(strings.NewReader(manifest))
+	reader.FieldsPerRecord = len(manifest_columns)
+	reader.TrimLeadingSpace = true
+
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+
+		if err == io.EOF { break }
+
+		if err != nil { return nil, validation_failed("Invalid CSV manifest: %s", err) }
+
+		if line == 0 && strings.EqualFold(record[0], manifest_columns[0]) {
+			for i, column := range manifest_columns {
+				if !strings.EqualFold(strings.TrimSpace(record[i]), column) { return nil, validation_failed("Invalid CSV manifest: unexpected column %s", record[i]) }
+			}
+			continue
+		}
+
+		specs = append(specs, DeviceSpec{IMEI: record[0], DeviceName: record[1], DeviceModel: record[2], DateOfManf: record[3]})
+	}
+
+	return specs, nil
+}
+
+//=================================================================================================
+//  create_devices_batch -- registers every device in a manifest in one transaction. All rows are
+//  validated first, including duplicates within the manifest and against the ledger; if any row
+//  is rejected nothing is written and the report is returned as the error.
+//=================================================================================================
+
+func (t *SimpleChainCode) create_devices_batch(stub shim.ChaincodeStubInterface, manifest string, format string) ([]byte, error) {
+
+	specs, err := parse_manifest(manifest, format)
+
+	if err != nil { fmt.Printf("CREATE_DEVICES_BATCH: %s", err); return nil, err }
+
+	if len(specs) == 0 { return nil, validation_failed("Manifest contains no devices") }
+
+	if len(specs) > MAX_BATCH_SIZE { return nil, validation_failed("Manifest contains %d devices, the limit is %d", len(specs), MAX_BATCH_SIZE) }
+
+	report := BatchReport{Total: len(specs)}
+	devices := make([]Device, 0, len(specs))
+	rows := make(map[string]int)
+
+	for i, spec := range specs {
+
+		row := BatchRow{Row: i + 1, IMEI: spec.IMEI, Status: STATUS_CREATED}
+
+		d, err := t.new_device(stub, spec)
+
+		if err == nil {
+			row.IMEI = d.IMEI
+			if first, dup := rows[d.IMEI]; dup {
+				err = fmt.Errorf("Duplicate of row %d", first)
+			} else if exists, xerr := t.device_exists(stub, d.IMEI); xerr != nil {
+				err = xerr
+			} else if exists {
+				err = duplicate_imei(d.IMEI)
+			}
+		}
+
+		if err != nil {
+			row.Status = "REJECTED"
+			row.Error = error_message(err)
+			report.Rejected++
+		} else {
+			rows[d.IMEI] = row.Row
+			devices = append(devices, d)
+		}
+
+		report.Rows = append(report.Rows, row)
+	}
+
+	if report.Rejected > 0 {
+		fmt.Printf("CREATE_DEVICES_BATCH: %d of %d rows rejected", report.Rejected, report.Total)
+		e := validation_failed("%d of %d rows rejected", report.Rejected, report.Total)
+		e.Details = report
+		return nil, e
+	}
+
+	for _, d := range devices {
+		err = t.store_new_device(stub, d)
+
+		if err != nil { return nil, err }
+	}
+
+	report.Created = len(devices)
+
+	bytes, err := json.Marshal(report)
+
+	if err != nil { return nil, errors.New("Error converting batch report") }
+
+	return bytes, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const BLACKLIST_KEY = "blacklist"
+
+const (
+	REPORT_STOLEN = "STOLEN"
+	REPORT_LOST   = "LOST"
+)
+
+//=================================================================================================
+//  BlacklistReport -- a device reported stolen or lost. While the report is open the device is
+//  Blacklisted: no transition is allowed on it, it cannot be handed in for an exchange and no
+//  warranty claim can be filed on it. Reports are kept after they are cleared. ReportedBy and
+//  ClearedBy identify the caller as reporter_id does.
+//=================================================================================================
+
+type BlacklistReport struct {
+	ID         string     `json:"id"`
+	IMEI       string     `json:"imei"`
+	Reason     string     `json:"reason"`
+	Reference  string     `json:"reference"`
+	ReportedBy string     `json:"reportedby"`
+	ReportedAt LedgerTime `json:"reportedat"`
+	Cleared    bool       `json:"cleared"`
+	Resolution string     `json:"resolution,omitempty"`
+	ClearedBy  string     `json:"clearedby,omitempty"`
+	ClearedAt  LedgerTime `json:"clearedat"`
+}
+
+// BlacklistStatus -- the public answer of check_blacklist. It leaves out who reported the device.
+type BlacklistStatus struct {
+	IMEI        string     `json:"imei"`
+	Blacklisted bool       `json:"blacklisted"`
+	Reason      string     `json:"reason,omitempty"`
+	Since       LedgerTime `json:"since"`
+}
+
+func blacklist_key(stub shim.ChaincodeStubInterface, imei string, id string) (string, error) {
+	return create_composite_key(stub, BLACKLIST_KEY, imei, id)
+}
+
+func (t *SimpleChainCode) save_report(stub shim.ChaincodeStubInterface, r BlacklistReport) ([]byte, error) {
+
+	bytes, err := json.Marshal(r)
+
+	if err != nil { return nil, errors.New("Error converting blacklist report") }
+
+	key, err := blacklist_key(stub, r.IMEI, r.ID)
+
+	if err != nil { return nil, err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("SAVE_REPORT: Error storing report %s: %s", r.ID, err); return nil, errors.New("Error storing blacklist report") }
+
+	return bytes, nil
+}
+
+func (t *SimpleChainCode) get_report(stub shim.ChaincodeStubInterface, imei string, id string) (BlacklistReport, error) {
+
+	var r BlacklistReport
+
+	key, err := blacklist_key(stub, imei, id)
+
+	if err != nil { return r, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil || bytes == nil { return r, errors.New("Unable to get blacklist report " + id) }
+
+	err = json.Unmarshal(bytes, &r)
+
+	if err != nil { return r, errors.New("Corrupt blacklist report " + id) }
+
+	return r, nil
+}
+
+//=================================================================================================
+//  reporter_id -- who the caller is on a report of the device: its party, or for a customer the
+//  customer_hash of its username
+//=================================================================================================
+
+func (t *SimpleChainCode) reporter_id(stub shim.ChaincodeStubInterface, callerAffiliation string, imei string) (string, error) {
+
+	if callerAffiliation != CUSTOMER { return t.get_party(stub) }
+
+	username, err := t.get_username(stub)
+
+	if err != nil { return "", permission_denied("Error retrieving caller information") }
+
+	return t.hash_customer(stub, imei, username)
+}
+
+//=================================================================================================
+//  may_report -- whether the caller can report the device. The party holding it can, the vendor
+//  can report any device, and a device sold to a customer can be reported by the customer or by
+//  a store that names the customer.
+//=================================================================================================
+
+func (t *SimpleChainCode) may_report(stub shim.ChaincodeStubInterface, callerAffiliation string, dev Device, customer string) error {
+
+	if callerAffiliation == VENDOR { return nil }
+
+	if callerAffiliation == dev.Owner && dev.Owner != CUSTOMER {
+		party, err := t.get_party(stub)
+		if err != nil { return err }
+		if party == dev.OwnerID { return nil }
+		return permission_denied("Device %s can only be reported by %s or the vendor", dev.IMEI, dev.OwnerID)
+	}
+
+	if dev.Owner == CUSTOMER {
+		if callerAffiliation == CUSTOMER {
+			username, err := t.get_username(stub)
+			if err != nil { return err }
+			customer = username
+		}
+		if callerAffiliation == CUSTOMER || callerAffiliation == STORE {
+			owned, err := t.is_customer(stub, dev.IMEI, dev.OwnerID, customer)
+			if err != nil { return err }
+			if owned { return nil }
+		}
+	}
+
+	return permission_denied("Device %s can only be reported by %s or the vendor", dev.IMEI, dev.Owner)
+}
+
+//=================================================================================================
+//  report_device -- opens a stolen or lost report, identified by the transaction id. reference is
+//  the police or insurance reference the report was made under.
+//=================================================================================================
+
+func (t *SimpleChainCode) report_device(stub shim.ChaincodeStubInterface, callerAffiliation string, reason string, imei string, reference string, customer string) ([]byte, error) {
+
+	dev, err := t.get_device(stub, imei)
+
+	if err != nil { return nil, err }
+
+	err = t.may_report(stub, callerAffiliation, dev, customer)
+
+	if err != nil { return nil, err }
+
+	if dev.Blacklisted != "" { return nil, new_error(ERR_ALREADY_EXISTS, "Device %s is already reported %s", imei, strings.ToLower(dev.Blacklisted)) }
+
+	if strings.TrimSpace(reference) == "" { return nil, validation_failed("A report reference is required") }
+
+	reporter, err := t.reporter_id(stub, callerAffiliation, dev.IMEI)
+
+	if err != nil { return nil, err }
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	r := BlacklistReport{ID: stub.GetTxID(), IMEI: dev.IMEI, Reason: reason, Reference: strings.TrimSpace(reference),
+		ReportedBy: reporter, ReportedAt: now}
+
+	dev.Blacklisted = reason
+	dev.Report = r.ID
+
+	_, err = t.save_changes(stub, dev)
+
+	if err != nil { return nil, err }
+
+	fmt.Printf("REPORT_DEVICE: %s reported %s by %s", imei, reason, callerAffiliation)
+
+	return t.save_report(stub, r)
+}
+
+//=================================================================================================
+//  clear_report -- closes the open report of a device, e.g. when it was recovered. Only the
+//  party that reported the device or the vendor can clear it.
+//=================================================================================================
+
+func (t *SimpleChainCode) clear_report(stub shim.ChaincodeStubInterface, callerAffiliation string, imei string, resolution string) ([]byte, error) {
+
+	dev, err := t.get_device(stub, imei)
+
+	if err != nil { return nil, err }
+
+	if dev.Blacklisted == "" { return nil, not_found("Device %s is not reported", imei) }
+
+	r, err := t.get_report(stub, dev.IMEI, dev.Report)
+
+	if err != nil { return nil, err }
+
+	clearer, err := t.reporter_id(stub, callerAffiliation, dev.IMEI)
+
+	if err != nil { return nil, err }
+
+	if clearer != r.ReportedBy && callerAffiliation != VENDOR { return nil, permission_denied("The report on %s can only be cleared by its reporter or the vendor", imei) }
+
+	if strings.TrimSpace(resolution) == "" { return nil, validation_failed("A resolution is required") }
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	r.Cleared = true
+	r.Resolution = resolution
+	r.ClearedBy = clearer
+	r.ClearedAt = now
+
+	dev.Blacklisted = ""
+	dev.Report = ""
+
+	_, err = t.save_changes(stub, dev)
+
+	if err != nil { return nil, err }
+
+	return t.save_report(stub, r)
+}
+
+//=================================================================================================
+//  check_blacklist -- whether an IMEI is reported stolen or lost. IMEIs the ledger does not know
+//  are not blacklisted, so a store can check any handset it is offered. An IMEISV is checked as
+//  the IMEI it contains.
+//=================================================================================================
+
+func (t *SimpleChainCode) check_blacklist(stub shim.ChaincodeStubInterface, imei string) ([]byte, error) {
+
+	if info, err := parse_imei(imei); err == nil { imei = info.IMEI }
+
+	s := BlacklistStatus{IMEI: imei}
+
+	dev, err := t.get_device(stub, imei)
+
+	if err != nil && as_chaincode_error(err).Code != ERR_DEVICE_NOT_FOUND { return nil, err }
+
+	if err == nil && dev.Blacklisted != "" {
+		r, err := t.get_report(stub, dev.IMEI, dev.Report)
+		if err != nil { return nil, err }
+		s.Blacklisted, s.Reason, s.Since = true, r.Reason, r.ReportedAt
+	}
+
+	return json.Marshal(s)
+}
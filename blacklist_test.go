@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func (l *test_ledger) blacklist(imei string) BlacklistStatus {
+	l.t.Helper()
+	var s BlacklistStatus
+	if err := json.Unmarshal([]byte(l.must("check_blacklist", imei)), &s); err != nil { l.t.Fatal(err) }
+	return s
+}
+
+func TestBlacklist(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei, other := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:2], imei)
+
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "report_stolen", imei, "POL-1")
+	l.as(WAREHOUSE).fails(ERR_VALIDATION_FAILED, "report_stolen", imei, " ")
+	l.must("report_stolen", imei, "POL-1")
+	l.fails(ERR_ALREADY_EXISTS, "report_lost", imei, "POL-2")
+
+	if s := l.blacklist(imei); !s.Blacklisted || s.Reason != REPORT_STOLEN || s.Since.IsZero() { t.Errorf("status %+v", s) }
+	if s := l.as(CUSTOMER).blacklist(test_imei(99)); s.Blacklisted { t.Errorf("unknown IMEI %+v", s) }
+
+	// no transition, whichever way it is called
+	ce := l.as(WAREHOUSE).fails(ERR_BLACKLISTED, "TRF_TO_STRE", imei, STORE, "C2")
+	if ce.IMEI != imei || ce.CurrentState == nil { t.Errorf("error does not name the device: %+v", ce) }
+	l.fails(ERR_BLACKLISTED, "DISPATCH_CONSIGNMENT", "S1", STORE, "DHL", STORE, `["`+imei+`"]`)
+
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "clear_report", imei, "recovered")
+	l.as(WAREHOUSE).fails(ERR_NOT_FOUND, "clear_report", other, "recovered")
+	l.must("clear_report", imei, "recovered")
+
+	if s := l.blacklist(imei); s.Blacklisted { t.Errorf("still blacklisted %+v", s) }
+	l.must("TRF_TO_STRE", imei, STORE, "C2")
+}
+
+func TestBlacklistCustomerDevice(t *testing.T) {
+
+	l := new_test_ledger(t)
+	old, replacement := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:4], old)
+	l.run_steps(to_vendor_and_back[:4], replacement)
+	l.as(STORE).selling(STORE, "customer").must("TRF_TO_CUST", old)
+
+	// the store reports for the customer it sold the device to, or the customer reports it
+	l.as(STORE).for_customer("someone else").fails(ERR_PERMISSION_DENIED, "report_lost", old, "INS-9")
+	l.as(WAREHOUSE).fails(ERR_PERMISSION_DENIED, "report_lost", old, "INS-9")
+	l.as(CUSTOMER).must("report_lost", old, "INS-9")
+	if s := l.blacklist(old[:14] + "07"); !s.Blacklisted { t.Errorf("IMEISV of a reported device %+v", s) }
+
+	// only the customer who reported it can clear it
+	l.as_user(CUSTOMER, "other", CUSTOMER).fails(ERR_PERMISSION_DENIED, "clear_report", old, "found")
+	// nor a user of the same name enrolled by another organisation
+	l.as_user(CUSTOMER, "customer", WAREHOUSE).fails(ERR_PERMISSION_DENIED, "clear_report", old, "found")
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "clear_report", old, "found")
+
+	l.as(STORE).for_customer("customer").fails(ERR_BLACKLISTED, "RTN_FROM_CUST", old, STORE)
+	l.for_customer("customer").fails(ERR_BLACKLISTED, "file_warranty_claim", old, `["DISPLAY"]`)
+
+	// found again, returned, and the store tries to exchange it after it was reported once more
+	l.as(CUSTOMER).must("clear_report", old, "found")
+	l.as(STORE).for_customer("customer").must("RTN_FROM_CUST", old, STORE)
+	l.as_party(STORE, "STORE2").fails(ERR_PERMISSION_DENIED, "report_stolen", old, "POL-7")
+	l.as(STORE).must("report_stolen", old, "POL-7")
+	l.as_party(STORE, "STORE2").fails(ERR_PERMISSION_DENIED, "clear_report", old, "found")
+	l.as(STORE).for_customer("customer").fails(ERR_BLACKLISTED, "EXCHANGE_DEV", replacement, old)
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const CONSIGNMENT_KEY = "consignment"
+
+const (
+	CONSIGNMENT_IN_TRANSIT         = "IN_TRANSIT"
+	CONSIGNMENT_RECEIVED           = "RECEIVED"
+	CONSIGNMENT_PARTIALLY_RECEIVED = "PARTIALLY_RECEIVED"
+)
+
+//=================================================================================================
+//  Consignment -- a shipment of devices between two parties. Origin and Destination are their
+//  roles, OriginParty and DestinationParty their MSP ids; the Recipient named at dispatch is the
+//  destination party. Every device is moved with the same dispatch transition and accepted with
+//  its AcceptedBy transition; Missing lists the devices that were dispatched but have not been
+//  accepted yet, Damaged those that arrived damaged and Discrepancies the cases opened on arrival.
+//=================================================================================================
+
+type Consignment struct {
+	Number           string     `json:"number"`
+	Origin           string     `json:"origin"`
+	OriginParty      string     `json:"originparty"`
+	Destination      string     `json:"destination"`
+	DestinationParty string     `json:"destinationparty"`
+	Carrier          string     `json:"carrier"`
+	Recipient        string     `json:"recipient"`
+	DispatchFunction string     `json:"dispatchfunction"`
+	Devices          []string   `json:"devices"`
+	Received         []string   `json:"received"`
+	Missing          []string   `json:"missing"`
+	Damaged          []string   `json:"damaged"`
+	Discrepancies    []string   `json:"discrepancies"`
+	DispatchedAt     LedgerTime `json:"dispatchedat"`
+	ArrivedAt        LedgerTime `json:"arrivedat"`
+	Status           string     `json:"status"`
+}
+
+// ConsignmentSummary -- the redacted view of a Consignment for parties other than its origin and
+// destination: not which devices it carries, who sent or receives them or when
+type ConsignmentSummary struct {
+	Number      string `json:"number"`
+	Origin      string `json:"origin"`
+	Destination string `json:"destination"`
+	Status      string `json:"status"`
+	Redacted    bool   `json:"redacted"`
+}
+
+func consignment_key(stub shim.ChaincodeStubInterface, number string) (string, error) {
+	return create_composite_key(stub, CONSIGNMENT_KEY, number)
+}
+
+//=================================================================================================
+//  is_party -- whether a caller is the party of role recorded as rolesParty. For records written
+//  before parties existed only the role is checked.
+//=================================================================================================
+
+func is_party(callerAffiliation string, party string, role string, rolesParty string) bool {
+	return callerAffiliation == role && (rolesParty == "" || party == rolesParty)
+}
+
+func (c Consignment) is_origin(callerAffiliation string, party string) bool {
+	return is_party(callerAffiliation, party, c.Origin, c.OriginParty)
+}
+
+func (c Consignment) is_destination(callerAffiliation string, party string) bool {
+	return is_party(callerAffiliation, party, c.Destination, c.DestinationParty)
+}
+
+//=================================================================================================
+//  get_consignment_record -- retrieves a consignment, reporting whether it exists
+//=================================================================================================
+
+func (t *SimpleChainCode) get_consignment_record(stub shim.ChaincodeStubInterface, number string) (Consignment, bool, error) {
+
+	var c Consignment
+
+	key, err := consignment_key(stub, number)
+
+	if err != nil { return c, false, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return c, false, errors.New("Unable to get consignment " + number) }
+
+	if bytes == nil { return c, false, nil }
+
+	err = json.Unmarshal(bytes, &c)
+
+	if err != nil { return c, false, errors.New("Corrupt consignment record " + number) }
+
+	return c, true, nil
+}
+
+func (t *SimpleChainCode) save_consignment(stub shim.ChaincodeStubInterface, c Consignment) error {
+
+	bytes, err := json.Marshal(c)
+
+	if err != nil { return errors.New("Error converting consignment record") }
+
+	key, err := consignment_key(stub, c.Number)
+
+	if err != nil { return err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("SAVE_CONSIGNMENT: Error storing consignment %s: %s", c.Number, err); return errors.New("Error storing consignment record") }
+
+	return nil
+}
+
+//=================================================================================================
+//  get_consignment -- returns a consignment to its origin and destination, and its
+//  ConsignmentSummary to the other supply chain parties
+//=================================================================================================
+
+func (t *SimpleChainCode) get_consignment(stub shim.ChaincodeStubInterface, r Reader, number string) ([]byte, error) {
+
+	if r.Affiliation == CUSTOMER { return nil, permission_denied("Consignments are not visible to customers") }
+
+	c, found, err := t.get_consignment_record(stub, number)
+
+	if err != nil { return nil, err }
+
+	if !found { return nil, not_found("Unknown consignment %s", number) }
+
+	if c.is_origin(r.Affiliation, r.Party) || c.is_destination(r.Affiliation, r.Party) { return json.Marshal(c) }
+
+	return json.Marshal(ConsignmentSummary{Number: c.Number, Origin: c.Origin, Destination: c.Destination, Status: c.Status, Redacted: true})
+}
+
+//=================================================================================================
+//  dispatch_function -- the shipping transition a caller uses to send a device to destination
+//=================================================================================================
+
+func dispatch_function(callerAffiliation string, destination string, dev Device) (string, error) {
+
+	for _, tr := range lifecycle {
+		if tr.AcceptedBy != "" && tr.Caller == callerAffiliation && tr.Recipient == destination &&
+			tr.From == dev.Status && (tr.Owner == "" || tr.Owner == dev.Owner) {
+			return tr.Function, nil
+		}
+	}
+
+	e := invalid_transition("DISPATCH_CONSIGNMENT", dev, nil)
+	e.Message = fmt.Sprintf("Device %s in status %s owned by %s cannot be shipped from %s to %s", dev.IMEI, dev.Status, dev.Owner, callerAffiliation, destination)
+
+	return "", e
+}
+
+//=================================================================================================
+//  parse_imei_list -- decodes a JSON array of IMEIs, rejecting empty lists and repeated entries
+//=================================================================================================
+
+func parse_imei_list(value string) ([]string, error) {
+
+	var imeis []string
+
+	err := json.Unmarshal([]byte(value), &imeis)
+
+	if err != nil { return nil, validation_failed("Expected a JSON array of IMEIs") }
+
+	if len(imeis) == 0 { return nil, validation_failed("The IMEI list is empty") }
+
+	seen := make(map[string]bool)
+
+	for i, imei := range imeis {
+		imeis[i] = strings.TrimSpace(imei)
+		if seen[imeis[i]] { return nil, validation_failed("IMEI %s is listed twice", imeis[i]) }
+		seen[imeis[i]] = true
+	}
+
+	return imeis, nil
+}
+
+//=================================================================================================
+//  dispatch_consignment -- ships every listed device to destination under one consignment number.
+//  All devices must be in a state that takes the same shipping transition.
+//=================================================================================================
+
+func (t *SimpleChainCode) dispatch_consignment(stub shim.ChaincodeStubInterface, callerAffiliation string, c Consignment, imeis []string) ([]byte, error) {
+
+	c.Number = strings.TrimSpace(c.Number)
+	c.Recipient = strings.TrimSpace(c.Recipient)
+
+	if c.Number == "" { return nil, validation_failed("Consignment number is required") }
+
+	if c.Recipient == "" { return nil, validation_failed("The recipient party is required") }
+
+	role, err := t.get_party_role(stub, c.Recipient)
+
+	if err != nil { return nil, err }
+
+	if role != c.Destination { return nil, validation_failed("Consignment %s goes to a %s, %s is not registered as one", c.Number, c.Destination, c.Recipient) }
+
+	party, err := t.get_party(stub)
+
+	if err != nil { return nil, err }
+
+	_, exists, err := t.get_consignment_record(stub, c.Number)
+
+	if err != nil { return nil, err }
+
+	if exists { return nil, new_error(ERR_ALREADY_EXISTS, "Consignment %s already exists", c.Number) }
+
+	changes := []DeviceChange{}
+
+	for _, imei := range imeis {
+
+		dev, err := t.get_device(stub, imei)
+
+		if err != nil { return nil, err }
+
+		function, err := dispatch_function(callerAffiliation, c.Destination, dev)
+
+		if err != nil { fmt.Printf("DISPATCH_CONSIGNMENT: %s", err); return nil, err }
+
+		if c.DispatchFunction == "" {
+			c.DispatchFunction = function
+		} else if c.DispatchFunction != function {
+			return nil, validation_failed("Device %s needs %s but consignment %s is shipped with %s", imei, function, c.Number, c.DispatchFunction)
+		}
+
+		change, err := t.run_transition(stub, callerAffiliation, function, []string{imei, c.Recipient, c.Number})
+
+		if err != nil { return nil, err }
+
+		changes = append(changes, change)
+	}
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	c.Origin = callerAffiliation
+	c.OriginParty = party
+	c.DestinationParty = c.Recipient
+	c.Devices = imeis
+	c.Received = []string{}
+	c.Missing = imeis
+	c.Damaged = []string{}
+	c.Discrepancies = []string{}
+	c.DispatchedAt = now
+	c.Status = CONSIGNMENT_IN_TRANSIT
+
+	err = t.save_consignment(stub, c)
+
+	if err != nil { return nil, err }
+
+	err = t.emit_lifecycle_event(stub, "DISPATCH_CONSIGNMENT", changes)
+
+	if err != nil { return nil, err }
+
+	return json.Marshal(c)
+}
+
+//=================================================================================================
+//  accept_consignment -- goods-in for a consignment. scanned lists the devices that arrived; nil
+//  means the whole consignment. Scanned devices that are outstanding are accepted, outstanding
+//  devices that were not scanned are marked IN_TRANSIT_MISSING and scanned devices that were not
+//  expected are recorded; any of these, or a damaged device, opens a discrepancy case. A device
+//  reported stolen or lost is not accepted and is listed in the case as blacklisted instead; it
+//  stays outstanding until the report is cleared. Missing devices can still be accepted by a later
+//  call. A device accepted on its own since the dispatch, or no longer shipped under this
+//  consignment, is counted as received rather than outstanding.
+//=================================================================================================
+
+func (t *SimpleChainCode) accept_consignment(stub shim.ChaincodeStubInterface, callerAffiliation string, number string, scanned []ScannedDevice) ([]byte, error) {
+
+	c, found, err := t.get_consignment_record(stub, number)
+
+	if err != nil { return nil, err }
+
+	if !found { return nil, not_found("Unknown consignment %s", number) }
+
+	party, err := t.get_party(stub)
+
+	if err != nil { return nil, err }
+
+	if !c.is_destination(callerAffiliation, party) { return nil, permission_denied("Consignment %s is addressed to %s %s", number, c.Destination, c.DestinationParty) }
+
+	if c.Status == CONSIGNMENT_RECEIVED { return nil, new_error(ERR_ALREADY_EXISTS, "Consignment %s has already been received", number) }
+
+	tr := lifecycle_transitions(c.DispatchFunction)
+
+	if len(tr) == 0 || tr[0].AcceptedBy == "" { return nil, errors.New("Consignment " + number + " has no acceptance transition") }
+
+	received := make(map[string]bool)
+	for _, imei := range c.Received { received[imei] = true }
+
+	pending := []string{}
+
+	for _, imei := range c.Missing {
+
+		dev, err := t.get_device(stub, imei)
+
+		if err != nil { return nil, err }
+
+		if dev.ConsignmentNumber == c.Number && (dev.Status == tr[0].To || dev.Status == STATUS_IN_TRANSIT_MISSING) {
+			pending = append(pending, imei)
+			continue
+		}
+
+		c.Received = append(c.Received, imei)
+		received[imei] = true
+	}
+
+	c.Missing = pending
+
+	if scanned == nil {
+		for _, imei := range c.Missing { scanned = append(scanned, ScannedDevice{IMEI: imei}) }
+	}
+
+	outstanding := make(map[string]bool)
+	for _, imei := range c.Missing { outstanding[imei] = true }
+
+	unexpected := []string{}
+	damaged := []string{}
+	held := []string{}
+	newlyMissing := []string{}
+	changes := []DeviceChange{}
+	blocked := make(map[string]bool)
+
+	for _, s := range scanned {
+
+		if received[s.IMEI] { continue }
+
+		if !outstanding[s.IMEI] {
+			unexpected = append(unexpected, s.IMEI)
+			// a device the ledger places elsewhere may be a clone
+			dev, err := t.get_device(stub, s.IMEI)
+			if err == nil { _, err = t.check_sighting(stub, "ACPT_CONSIGNMENT", dev, callerAffiliation, party, "") }
+			if err != nil && as_chaincode_error(err).Code != ERR_DEVICE_NOT_FOUND { return nil, err }
+			continue
+		}
+
+		change, err := t.run_transition(stub, callerAffiliation, tr[0].AcceptedBy, []string{s.IMEI, c.Recipient})
+
+		if err != nil && as_chaincode_error(err).Code == ERR_BLACKLISTED {
+			held = append(held, s.IMEI)
+			blocked[s.IMEI] = true
+			continue
+		}
+
+		if err != nil { return nil, err }
+
+		changes = append(changes, change)
+
+		delete(outstanding, s.IMEI)
+		c.Received = append(c.Received, s.IMEI)
+
+		if s.Damaged {
+			damaged = append(damaged, s.IMEI)
+			c.Damaged = append(c.Damaged, s.IMEI)
+		}
+	}
+
+	missing := []string{}
+
+	for _, imei := range c.Devices {
+
+		if !outstanding[imei] { continue }
+
+		missing = append(missing, imei)
+
+		if blocked[imei] { continue }
+
+		dev, err := t.get_device(stub, imei)
+
+		if err != nil { return nil, err }
+
+		if dev.Status == STATUS_IN_TRANSIT_MISSING { continue }
+
+		if dev.Blacklisted != "" { held = append(held, imei); continue }
+
+		change, err := t.run_transition(stub, callerAffiliation, "MARK_MISSING", []string{imei})
+
+		if err != nil { return nil, err }
+
+		changes = append(changes, change)
+
+		newlyMissing = append(newlyMissing, imei)
+	}
+
+	c.Missing = missing
+
+	if len(newlyMissing) > 0 || len(unexpected) > 0 || len(damaged) > 0 || len(held) > 0 {
+		d, err := t.open_discrepancy(stub, c, newlyMissing, unexpected, damaged, held)
+
+		if err != nil { return nil, err }
+
+		c.Discrepancies = append(c.Discrepancies, d.ID)
+	}
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	c.ArrivedAt = now
+	c.Status = CONSIGNMENT_RECEIVED
+
+	if len(c.Missing) > 0 {
+		c.Status = CONSIGNMENT_PARTIALLY_RECEIVED
+		fmt.Printf("ACCEPT_CONSIGNMENT: %s partially received, %d devices missing", number, len(c.Missing))
+	}
+
+	err = t.save_consignment(stub, c)
+
+	if err != nil { return nil, err }
+
+	err = t.emit_lifecycle_event(stub, "ACPT_CONSIGNMENT", changes)
+
+	if err != nil { return nil, err }
+
+	return json.Marshal(c)
+}
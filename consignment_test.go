@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func (l *test_ledger) consignment(number string) Consignment {
+	l.t.Helper()
+	var c Consignment
+	if err := json.Unmarshal([]byte(l.must("get_consignment", number)), &c); err != nil { l.t.Fatal(err) }
+	return c
+}
+
+func TestConsignment(t *testing.T) {
+
+	l := new_test_ledger(t)
+	a, b, c := l.create(1), l.create(2), l.create(3)
+	list := `["` + a + `","` + b + `","` + c + `"]`
+
+	l.as(STORE).fails(ERR_INVALID_TRANSITION, "DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", WAREHOUSE, list)
+	l.as(VENDOR).fails(ERR_VALIDATION_FAILED, "DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", WAREHOUSE, "not json")
+
+	l.must("DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", WAREHOUSE, list)
+	l.fails(ERR_ALREADY_EXISTS, "DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", WAREHOUSE, list)
+
+	if s := l.consignment("S1"); s.Status != CONSIGNMENT_IN_TRANSIT || s.DispatchFunction != "TRF_TO_WH" || len(s.Missing) != 3 {
+		t.Errorf("dispatched %+v", s)
+	}
+
+	l.fails(ERR_PERMISSION_DENIED, "ACPT_CONSIGNMENT", "S1")
+
+	// another warehouse can neither take the consignment nor one of its devices
+	l.as_party(WAREHOUSE, "WH2").fails(ERR_PERMISSION_DENIED, "ACPT_CONSIGNMENT", "S1")
+	l.fails(ERR_PERMISSION_DENIED, "ACPT_FROM_VENDOR", a, WAREHOUSE)
+
+	// a device is only marked missing by the acceptance of its consignment
+	l.as(WAREHOUSE).fails(ERR_UNKNOWN_FUNCTION, "MARK_MISSING", c)
+
+	// b is damaged, c did not arrive and an unknown device was in the box
+	scan := `[{"imei":"` + a + `"},{"imei":"` + b + `","damaged":true},{"imei":"` + test_imei(9) + `"}]`
+	l.as(WAREHOUSE).must("ACPT_CONSIGNMENT", "S1", scan)
+
+	s := l.consignment("S1")
+	if s.Status != CONSIGNMENT_PARTIALLY_RECEIVED || len(s.Received) != 2 || len(s.Missing) != 1 || len(s.Discrepancies) != 1 {
+		t.Fatalf("accepted %+v", s)
+	}
+	if d := l.device(c); d.Status != STATUS_IN_TRANSIT_MISSING { t.Errorf("missing device is %s", d.Status) }
+
+	var cases []Discrepancy
+	if err := json.Unmarshal([]byte(l.must("get_discrepancies", "S1")), &cases); err != nil { t.Fatal(err) }
+	if len(cases) != 1 || len(cases[0].Missing) != 1 || len(cases[0].Unexpected) != 1 || len(cases[0].Damaged) != 1 {
+		t.Fatalf("discrepancies %+v", cases)
+	}
+
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "get_discrepancies", "S1")
+	l.as_party(WAREHOUSE, "WH2").fails(ERR_PERMISSION_DENIED, "get_discrepancies", "S1")
+	l.fails(ERR_PERMISSION_DENIED, "resolve_discrepancy", "S1", cases[0].ID, "not ours")
+	l.fails(ERR_PERMISSION_DENIED, "ACPT_FROM_VENDOR", c, WAREHOUSE)
+	l.as(VENDOR).must("resolve_discrepancy", "S1", cases[0].ID, "credited")
+	l.fails(ERR_VALIDATION_FAILED, "resolve_discrepancy", "S1", cases[0].ID, "credited again")
+
+	// the missing device turns up later
+	l.as(WAREHOUSE).must("ACPT_CONSIGNMENT", "S1", `["`+c+`"]`)
+
+	if s := l.consignment("S1"); s.Status != CONSIGNMENT_RECEIVED || len(s.Missing) != 0 { t.Errorf("completed %+v", s) }
+	if d := l.device(c); d.Status != STATUS_RECEIVED || d.Owner != WAREHOUSE { t.Errorf("late device %+v", d) }
+
+	l.fails(ERR_ALREADY_EXISTS, "ACPT_CONSIGNMENT", "S1")
+	l.fails(ERR_NOT_FOUND, "get_consignment", "S2")
+}
+
+func TestConsignmentWithBlacklistedDevice(t *testing.T) {
+
+	l := new_test_ledger(t)
+	a, b := l.create(1), l.create(2)
+	l.must("DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", WAREHOUSE, `["`+a+`","`+b+`"]`)
+	l.must("report_stolen", b, "POL-1")
+
+	// the stolen device is held back and listed in the case, the rest of the box is accepted
+	l.as(WAREHOUSE).must("ACPT_CONSIGNMENT", "S1")
+
+	s := l.consignment("S1")
+	if s.Status != CONSIGNMENT_PARTIALLY_RECEIVED || len(s.Received) != 1 || len(s.Missing) != 1 || s.Missing[0] != b { t.Fatalf("accepted %+v", s) }
+	if d := l.device(b); d.Status != STATUS_DELIVERED_TO_WAREHOUSE { t.Errorf("held device is %s", d.Status) }
+
+	var cases []Discrepancy
+	if err := json.Unmarshal([]byte(l.must("get_discrepancies", "S1")), &cases); err != nil { t.Fatal(err) }
+	if len(cases) != 1 || len(cases[0].Blacklisted) != 1 || cases[0].Blacklisted[0] != b || len(cases[0].Missing) != 0 { t.Fatalf("discrepancies %+v", cases) }
+
+	l.as(VENDOR).must("clear_report", b, "recovered")
+	l.as(WAREHOUSE).must("ACPT_CONSIGNMENT", "S1", `["`+b+`"]`)
+
+	if s := l.consignment("S1"); s.Status != CONSIGNMENT_RECEIVED { t.Errorf("completed %+v", s) }
+}
+
+func TestConsignmentWithDeviceAcceptedAlone(t *testing.T) {
+
+	l := new_test_ledger(t)
+	a, b, c := l.create(1), l.create(2), l.create(3)
+	l.must("DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", WAREHOUSE, `["`+a+`","`+b+`"]`)
+	l.must("DISPATCH_CONSIGNMENT", "S2", WAREHOUSE, "DHL", WAREHOUSE, `["`+c+`"]`)
+
+	// a is accepted on its own, the consignment still accepts the rest and counts a as received
+	l.as(WAREHOUSE).must("ACPT_FROM_VENDOR", a, WAREHOUSE)
+	l.must("ACPT_CONSIGNMENT", "S1", `["`+b+`"]`)
+
+	s := l.consignment("S1")
+	if s.Status != CONSIGNMENT_RECEIVED || len(s.Received) != 2 || len(s.Missing) != 0 || len(s.Discrepancies) != 0 { t.Fatalf("accepted %+v", s) }
+	if d := l.device(b); d.Status != STATUS_RECEIVED { t.Errorf("scanned device is %s", d.Status) }
+
+	// accepting the whole box after its only device came in alone completes it
+	l.must("ACPT_FROM_VENDOR", c, WAREHOUSE)
+	l.must("ACPT_CONSIGNMENT", "S2")
+
+	if s := l.consignment("S2"); s.Status != CONSIGNMENT_RECEIVED || len(s.Received) != 1 { t.Errorf("completed %+v", s) }
+}
+
+func TestConsignmentToWrongRole(t *testing.T) {
+
+	l := new_test_ledger(t)
+	a := l.create(1)
+
+	// a store cannot take a shipment meant for a warehouse, nor can an unknown party
+	l.fails(ERR_VALIDATION_FAILED, "DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", STORE, `["`+a+`"]`)
+	l.fails(ERR_VALIDATION_FAILED, "DISPATCH_CONSIGNMENT", "S1", WAREHOUSE, "DHL", "NOBODY", `["`+a+`"]`)
+	l.fails(ERR_VALIDATION_FAILED, "TRF_TO_WH", a, STORE, "C1")
+	l.fails(ERR_NOT_FOUND, "get_consignment", "S1")
+
+	if d := l.device(a); d.Status != STATUS_CREATED || d.ShippedTo != "" { t.Errorf("device %+v", d) }
+
+	l.must("TRF_TO_WH", a, WAREHOUSE, "C1")
+}
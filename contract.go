@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-contract-api-go/metadata"
+)
+
+const CONTRACT_VERSION = "2.0.0"
+
+//=================================================================================================
+//  DeviceContract -- the chaincode as a fabric-contract-api-go contract. The typed transactions
+//  below take structured arguments and go through the same registry checks as the legacy
+//  functions; results are the JSON documents the ledger stores, so old and new clients read the
+//  same shapes. Any other function name (create_device, TRF_TO_WH, get_device_details, ...) is
+//  handled by legacy with the positional string arguments the old Invoke and Query took.
+//=================================================================================================
+
+type DeviceContract struct {
+	contractapi.Contract
+	chaincode SimpleChainCode
+}
+
+func new_device_contract() *DeviceContract {
+
+	c := new(DeviceContract)
+	c.Name = "DeviceContract"
+	c.Info = metadata.InfoMetadata{Title: "Device supply chain", Version: CONTRACT_VERSION}
+	c.UnknownTransaction = c.legacy
+
+	return c
+}
+
+//=================================================================================================
+//  legacy -- runs a function by its pre-contract name with the transaction's string arguments
+//=================================================================================================
+
+func (c *DeviceContract) legacy(ctx contractapi.TransactionContextInterface) (string, error) {
+
+	function, args := ctx.GetStub().GetFunctionAndParameters()
+
+	return c.call(ctx, function, args...)
+}
+
+func (c *DeviceContract) call(ctx contractapi.TransactionContextInterface, function string, args ...string) (string, error) {
+
+	bytes, err := c.chaincode.call(ctx.GetStub(), function, args)
+
+	if err != nil { return "", err }
+
+	return string(bytes), nil
+}
+
+// to_json encodes a typed argument into the string form the registry functions take
+func to_json(value interface{}) (string, error) {
+
+	bytes, err := json.Marshal(value)
+
+	if err != nil { return "", validation_failed("Unable to encode argument: %s", err) }
+
+	return string(bytes), nil
+}
+
+//=================================================================================================
+//  Typed transactions
+//=================================================================================================
+
+// InitLedger stores the default device template
+func (c *DeviceContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
+
+	_, err := c.chaincode.init_ledger(ctx.GetStub())
+
+	if err != nil { return as_chaincode_error(err) }
+
+	return nil
+}
+
+// CreateDevice registers a device and returns it
+func (c *DeviceContract) CreateDevice(ctx contractapi.TransactionContextInterface, spec DeviceSpec) (string, error) {
+
+	arg, err := to_json(spec)
+
+	if err != nil { return "", err }
+
+	return c.call(ctx, "create_device", arg)
+}
+
+// CreateDevices registers every device of the list, or none of them, and returns the BatchReport
+func (c *DeviceContract) CreateDevices(ctx contractapi.TransactionContextInterface, specs []DeviceSpec) (string, error) {
+
+	arg, err := to_json(specs)
+
+	if err != nil { return "", err }
+
+	return c.call(ctx, "create_devices_batch", arg, "json")
+}
+
+// ReadDevice returns a device, or its DeviceSummary when the caller's read policy does not cover it
+func (c *DeviceContract) ReadDevice(ctx contractapi.TransactionContextInterface, imei string) (string, error) {
+
+	return c.call(ctx, "get_device_details", imei)
+}
+
+// DeviceExists reports whether a device is stored under the IMEI
+func (c *DeviceContract) DeviceExists(ctx contractapi.TransactionContextInterface, imei string) (bool, error) {
+
+	exists, err := c.chaincode.device_exists(ctx.GetStub(), imei)
+
+	if err != nil { return false, as_chaincode_error(err) }
+
+	return exists, nil
+}
+
+// GetDevices returns one DevicePage of the devices the caller may read matching the filter, a
+// DeviceFilter in JSON. The filter stays a string because a struct with no required field does
+// not pass the contract API's metadata schema.
+func (c *DeviceContract) GetDevices(ctx contractapi.TransactionContextInterface, filter string) (string, error) {
+
+	return c.call(ctx, "get_devices", filter)
+}
+
+// GetDeviceHistory returns the custody chain of a device, as EventSummary records when the
+// caller's read policy does not cover it
+func (c *DeviceContract) GetDeviceHistory(ctx contractapi.TransactionContextInterface, imei string) (string, error) {
+
+	return c.call(ctx, "get_device_history", imei)
+}
+
+// Transition moves a device along a lifecycle edge, e.g. TRF_TO_WH with imei, recipient and
+// consignment
+func (c *DeviceContract) Transition(ctx contractapi.TransactionContextInterface, function string, args []string) error {
+
+	if lifecycle_transitions(function) == nil { return as_chaincode_error(validation_failed("Unknown lifecycle function %s", function)) }
+
+	_, err := c.call(ctx, function, args...)
+
+	return err
+}
+
+// ExchangeDevice hands a customer imei for the returned oldimei and returns the Exchange record;
+// kind is LIKE_FOR_LIKE or UPGRADE, difference the price an upgrade cost the customer. The
+// customer id is passed in the transient field customer.
+func (c *DeviceContract) ExchangeDevice(ctx contractapi.TransactionContextInterface, imei string, oldimei string, kind string, difference string) (string, error) {
+
+	return c.call(ctx, "EXCHANGE_DEV", imei, oldimei, kind, difference)
+}
+
+// CheckWarranty returns the WarrantyStatus of a device on date, or today if date is empty; a caller
+// whose read policy does not cover the device gets a WarrantySummary
+func (c *DeviceContract) CheckWarranty(ctx contractapi.TransactionContextInterface, imei string, date string) (string, error) {
+
+	return c.call(ctx, "check_warranty", imei, date)
+}
+
+// FileWarrantyClaim opens a warranty claim for the customer a device was sold to, whose id is
+// passed in the transient field customer
+func (c *DeviceContract) FileWarrantyClaim(ctx contractapi.TransactionContextInterface, imei string, faultcodes []string, description string) (string, error) {
+
+	arg, err := to_json(faultcodes)
+
+	if err != nil { return "", err }
+
+	return c.call(ctx, "file_warranty_claim", imei, arg, description)
+}
+
+// GetSale returns the private SaleRecord of the last sale of a device to members of the sales
+// collection whose read policy covers the device
+func (c *DeviceContract) GetSale(ctx contractapi.TransactionContextInterface, imei string) (string, error) {
+
+	return c.call(ctx, "get_sale", imei)
+}
+
+// GetStoreMargin returns the StoreMargin of the last sale of a device to the stores
+func (c *DeviceContract) GetStoreMargin(ctx contractapi.TransactionContextInterface, imei string) (string, error) {
+
+	return c.call(ctx, "get_store_margin", imei)
+}
+
+// CheckBlacklist returns the BlacklistStatus of an IMEI
+func (c *DeviceContract) CheckBlacklist(ctx contractapi.TransactionContextInterface, imei string) (string, error) {
+
+	return c.call(ctx, "check_blacklist", imei)
+}
+
+// DispatchConsignment ships the listed devices to destination under one consignment number
+func (c *DeviceContract) DispatchConsignment(ctx contractapi.TransactionContextInterface, number string, destination string, carrier string, recipient string, imeis []string) (string, error) {
+
+	arg, err := to_json(imeis)
+
+	if err != nil { return "", err }
+
+	return c.call(ctx, "DISPATCH_CONSIGNMENT", number, destination, carrier, recipient, arg)
+}
+
+// AcceptConsignment accepts the scanned devices of a consignment; an empty list accepts all of it
+func (c *DeviceContract) AcceptConsignment(ctx contractapi.TransactionContextInterface, number string, scanned []ScannedDevice) (string, error) {
+
+	if len(scanned) == 0 { return c.call(ctx, "ACPT_CONSIGNMENT", number) }
+
+	arg, err := to_json(scanned)
+
+	if err != nil { return "", err }
+
+	return c.call(ctx, "ACPT_CONSIGNMENT", number, arg)
+}
+
+// ReadConsignment returns a consignment
+func (c *DeviceContract) ReadConsignment(ctx contractapi.TransactionContextInterface, number string) (string, error) {
+
+	return c.call(ctx, "get_consignment", number)
+}
+
+// DescribeFunctions lists the legacy functions with their argument schemas
+func (c *DeviceContract) DescribeFunctions(ctx contractapi.TransactionContextInterface) (string, error) {
+
+	return c.call(ctx, "describe_functions")
+}
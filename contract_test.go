@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestDeviceContract(t *testing.T) {
+
+	chaincode, err := contractapi.NewChaincode(new_device_contract())
+	if err != nil { t.Fatal(err) }
+
+	stub := shimtest.NewMockStub("devices", chaincode)
+	stub.Creator = test_identity(t, VENDOR, "vendor", VENDOR)
+
+	stub.MockTransactionStart("seed")
+	if err := seed_vendor(stub); err != nil { t.Fatal(err) }
+	stub.MockTransactionEnd("seed")
+
+	invoke := func(args ...string) (string, int32) {
+		bytes := [][]byte{}
+		for _, a := range args { bytes = append(bytes, []byte(a)) }
+		res := stub.MockInvoke("tx", bytes)
+		if res.Status != shim.OK { return res.Message, res.Status }
+		return string(res.Payload), res.Status
+	}
+
+	imei := test_imei(1)
+	spec, _ := json.Marshal(DeviceSpec{IMEI: imei, DeviceName: "LENOVO", DeviceModel: "VIBE", DateOfManf: "2016-12-03"})
+
+	if out, status := invoke("InitLedger"); status != shim.OK { t.Fatal(out) }
+	if out, status := invoke("CreateDevice", string(spec)); status != shim.OK { t.Fatal(out) }
+
+	// the legacy names still work
+	if out, status := invoke("TRF_TO_WH", imei, "WarehouseMSP", "C1"); status != shim.OK { t.Fatal(out) }
+
+	var d Device
+	out, status := invoke("ReadDevice", imei)
+	if status != shim.OK || json.Unmarshal([]byte(out), &d) != nil || d.Status != STATUS_DELIVERED_TO_WAREHOUSE { t.Fatalf("ReadDevice: %s", out) }
+
+	out, status = invoke("get_device_details", test_imei(2))
+	if status == shim.OK || error_of(t, errorString(out)).Code != ERR_DEVICE_NOT_FOUND { t.Errorf("missing device: %s", out) }
+
+	if out, status := invoke("DeviceExists", imei); status != shim.OK || out != "true" { t.Errorf("DeviceExists: %s", out) }
+}
+
+type errorString string
+
+func (e errorString) Error() string { return string(e) }
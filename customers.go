@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  Customer ids are only stored as a customer_hash, an HMAC of the IMEI and the id under the
+//  customer secret. The secret is set once by the vendor and kept in CUSTOMER_KEYS_COLLECTION,
+//  which only the peers of the supply chain parties hold, so an owner id read from the public
+//  ledger cannot be tested against guessed customer ids. The IMEI keeps the same customer from
+//  being linked across devices by comparing owner ids.
+//  Customers sign with the MSPs registered for them, which are not members of the collection:
+//  their peers must not hold the secret. Every customer query and report hashes the caller's
+//  username with it, so the collection is not memberOnlyRead and the chaincode on the supply
+//  chain peers is what guards it. It reads the secret only for callers check_affiliation has
+//  accepted and never returns it; a customer is trusted for the enrolment id its MSP issued, and
+//  the vendor for registering no MSP that would issue another customer's id. Only the supply
+//  chain parties may write it.
+//=================================================================================================
+
+const CUSTOMER_KEYS_COLLECTION = "customerKeys"
+
+const CUSTOMER_SECRET_KEY = "customersecret"
+
+// TRANSIENT_CUSTOMER_SECRET is the transient field set_customer_secret reads the secret from
+const TRANSIENT_CUSTOMER_SECRET = "customersecret"
+
+const MIN_CUSTOMER_SECRET_LENGTH = 32
+
+// TRANSIENT_CUSTOMER is the transient field the customer id is passed in, so that it is not
+// written to the transaction. A sale passes it in its SaleDetails instead.
+const TRANSIENT_CUSTOMER = "customer"
+
+func customer_hash(secret []byte, imei string, customer string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(imei + "\u0000" + strings.TrimSpace(customer)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//=================================================================================================
+//  get_customer_secret -- reads the customer secret, failing if it has not been set
+//=================================================================================================
+
+func (t *SimpleChainCode) get_customer_secret(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	key, err := create_composite_key(stub, CUSTOMER_SECRET_KEY)
+
+	if err != nil { return nil, err }
+
+	secret, err := stub.GetPrivateData(CUSTOMER_KEYS_COLLECTION, key)
+
+	if err != nil { fmt.Printf("GET_CUSTOMER_SECRET: %s", err); return nil, errors.New("Unable to read the customer secret") }
+
+	if secret == nil { return nil, errors.New("The customer secret has not been set") }
+
+	return secret, nil
+}
+
+//=================================================================================================
+//  set_customer_secret -- stores the customer secret passed in the transient map. It can only be
+//  set once: every owner id is hashed under it.
+//=================================================================================================
+
+func (t *SimpleChainCode) set_customer_secret(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	transient, err := stub.GetTransient()
+
+	if err != nil { return nil, errors.New("Unable to read transient data") }
+
+	secret := transient[TRANSIENT_CUSTOMER_SECRET]
+
+	if len(secret) < MIN_CUSTOMER_SECRET_LENGTH { return nil, validation_failed("The customer secret must be passed in the transient field %s and be at least %d bytes", TRANSIENT_CUSTOMER_SECRET, MIN_CUSTOMER_SECRET_LENGTH) }
+
+	key, err := create_composite_key(stub, CUSTOMER_SECRET_KEY)
+
+	if err != nil { return nil, err }
+
+	existing, err := stub.GetPrivateData(CUSTOMER_KEYS_COLLECTION, key)
+
+	if err != nil { return nil, errors.New("Unable to read the customer secret") }
+
+	if existing != nil { return nil, new_error(ERR_ALREADY_EXISTS, "The customer secret is already set") }
+
+	err = stub.PutPrivateData(CUSTOMER_KEYS_COLLECTION, key, secret)
+
+	if err != nil { fmt.Printf("SET_CUSTOMER_SECRET: %s", err); return nil, errors.New("Error storing the customer secret") }
+
+	return nil, nil
+}
+
+//=================================================================================================
+//  hash_customer -- the customer_hash of a customer id for a device
+//=================================================================================================
+
+func (t *SimpleChainCode) hash_customer(stub shim.ChaincodeStubInterface, imei string, customer string) (string, error) {
+
+	secret, err := t.get_customer_secret(stub)
+
+	if err != nil { return "", err }
+
+	return customer_hash(secret, imei, customer), nil
+}
+
+//=================================================================================================
+//  get_private_input -- an input passed in the transient map rather than as an argument: the
+//  field of that name, except for the customer of a sale, which is part of the SaleDetails
+//=================================================================================================
+
+func get_private_input(stub shim.ChaincodeStubInterface, name string) (string, error) {
+
+	transient, err := stub.GetTransient()
+
+	if err != nil { return "", errors.New("Unable to read transient data") }
+
+	if _, found := transient[TRANSIENT_SALE]; !found || name != TRANSIENT_CUSTOMER { return strings.TrimSpace(string(transient[name])), nil }
+
+	details, err := get_sale_details(stub)
+
+	if err != nil { return "", err }
+
+	return details.Customer, nil
+}
+
+// get_customer -- the customer id the caller passed in the transient map, if any
+func get_customer(stub shim.ChaincodeStubInterface) (string, error) {
+	return get_private_input(stub, TRANSIENT_CUSTOMER)
+}
+
+//=================================================================================================
+//  is_customer -- whether customer is the customer id ownerid was hashed from
+//=================================================================================================
+
+func (t *SimpleChainCode) is_customer(stub shim.ChaincodeStubInterface, imei string, ownerid string, customer string) (bool, error) {
+
+	if strings.TrimSpace(customer) == "" || ownerid == "" { return false, nil }
+
+	secret, err := t.get_customer_secret(stub)
+
+	if err != nil { return false, err }
+
+	return owned_by(secret, imei, ownerid, customer), nil
+}
+
+func owned_by(secret []byte, imei string, ownerid string, customer string) bool {
+
+	if strings.TrimSpace(customer) == "" || ownerid == "" { return false }
+
+	return customer_hash(secret, imei, customer) == ownerid
+}
+
+//=================================================================================================
+//  migrate_owners -- devices sold before owner ids existed have the customer's name as owner.
+//  Moves that name into a hashed owner id and sets the owner to CUSTOMER, so they can be returned.
+//  Run migrate_sellers first.
+//=================================================================================================
+
+func (t *SimpleChainCode) migrate_owners(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	count := 0
+
+	secret, err := t.get_customer_secret(stub)
+
+	if err != nil { return nil, err }
+
+	err = t.for_each_partial_key(stub, DEVICE_INDEX, nil, func(key string, value []byte) (bool, error) {
+
+		var dev Device
+
+		err := json.Unmarshal(value, &dev)
+
+		if err != nil { fmt.Printf("MIGRATE_OWNERS: unable to read device %s", key); return false, errors.New("Unable to migrate device " + key) }
+
+		if _, known := affiliations[dev.Owner]; known || dev.Owner == "" { return true, nil }
+
+		if legacy_seller(value) != "" { return false, validation_failed("Device %s still records its seller, run migrate_sellers first", dev.IMEI) }
+
+		dev.OwnerID = customer_hash(secret, dev.IMEI, dev.Owner)
+		dev.Owner = CUSTOMER
+
+		_, err = t.save_changes(stub, dev)
+
+		if err != nil { return false, err }
+
+		count++
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	return []byte(fmt.Sprintf("%d", count)), nil
+}
@@ -3,555 +3,367 @@ package main
 import (
 	"fmt"
 	"errors"
-	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 	"encoding/json"
-	"time"
+	"strings"
 )
 
-var logger = shim.NewLogger("DIChaincode")
-
+// IMEI_Holder is the index of all devices used before devices were keyed under device~imei.
+// It is only read by migrate_imei_index.
 type IMEI_Holder struct {
 	IMEIs 	[]string `json:"imeis"`
 }
 
+// Device -- Owner is the type of party holding the device (VENDOR, WAREHOUSE, STORE or CUSTOMER)
+// and OwnerID names the party by its MSP id; for a customer it is the customer_hash of the
+// customer id. CreatedBy is the party of the vendor that created the device and SellingStore
+// that of the store that last sold it. A device on its way to another party is ShippedTo that
+// party until it accepts it.
+// A device handed out in an exchange Replaces the returned one, which is ReplacedBy it; OldIMEI
+// holds the same link as Replaces for clients of the original record. A device a customer
+// returned keeps the customer_hash of that customer in ReturnedBy, so that only they can exchange
+// it. Claim is the warranty claim open on the device and Repair the repair in progress; a device
+// that came out of a repair is Refurbished, with the Grade it was given. A device reported stolen
+// or lost is Blacklisted with the reason until the report is cleared. Sale is the id of the
+// private SaleRecord of the last sale and SaleHash its hash.
 type Device struct {
 	DeviceName     string `json:"devicename"`
 	DeviceModel    string `json:"devicemodel"`
-	DateOfManf     string `json:"dateofmanf"`
+	DateOfManf     LedgerTime `json:"dateofmanf"`
 	ConsignmentNumber string `json:"consignmentnumber"`
-	DateOfDelivery string `json:"dateofdelivery"`
-	DateOfReceipt  string `json:"dateofreceipt"`
-	DateOfSale     string `json:"dateofsale"`
+	DateOfDelivery LedgerTime `json:"dateofdelivery"`
+	DateOfReceipt  LedgerTime `json:"dateofreceipt"`
+	DateOfSale     LedgerTime `json:"dateofsale"`
+	WarrantyExpires LedgerTime `json:"warrantyexpires"`
 	OldIMEI        string `json:"oldimei"`
+	Replaces       string `json:"replaces,omitempty"`
+	ReplacedBy     string `json:"replacedby,omitempty"`
+	ReturnedBy     string `json:"returnedby,omitempty"`
 	IMEI	       string `json:"imei"`
+	SVN            string `json:"svn,omitempty"`
 	Status         string `json:"status"`
-	SoldBy         string `json:"soldby"`
 	Owner          string `json:"owner"`
+	OwnerID        string `json:"ownerid"`
+	ShippedTo      string `json:"shippedto,omitempty"`
+	CreatedBy      string `json:"createdby,omitempty"`
+	SellingStore   string `json:"sellingstore,omitempty"`
+	Claim          string `json:"claim,omitempty"`
+	Repair         string `json:"repair,omitempty"`
+	Refurbished    bool   `json:"refurbished,omitempty"`
+	Grade          string `json:"grade,omitempty"`
+	Blacklisted    string `json:"blacklisted,omitempty"`
+	Report         string `json:"report,omitempty"`
+	Sale           string `json:"sale,omitempty"`
+	SaleHash       string `json:"salehash,omitempty"`
+}
+
+// condition -- CONDITION_REFURBISHED for a device that was refurbished, CONDITION_NEW otherwise
+func (d Device) condition() string {
+	if d.Refurbished { return CONDITION_REFURBISHED }
+	return CONDITION_NEW
 }
 
+//=================================================================================================
+//  SimpleChainCode -- the device logic. DeviceContract exposes it as contract transactions and
+//  passes every legacy function name through call.
+//=================================================================================================
+
 type SimpleChainCode struct {
 }
 
-func (t *SimpleChainCode) Init(stub shim.ChaincodeStubInterface, function string, args[] string) ([]byte, error ) {
+func (t *SimpleChainCode) init_ledger(stub shim.ChaincodeStubInterface) ([]byte, error) {
 	
-	var imeiIds IMEI_Holder
+	return t.set_device_template(stub, default_template)
+}
+
+//=================================================================================================
+//  call -- runs a registered function; every error it returns is a ChaincodeError, serialized as
+//  JSON
+//=================================================================================================
+
+func (t *SimpleChainCode) call(stub shim.ChaincodeStubInterface, function string, args[] string) ([]byte, error) {
+
+	spec, err := lookup_function(function)
+
+	if err != nil { return nil, as_chaincode_error(err) }
+
+	var bytes []byte
+
+	if spec.Type == FUNCTION_QUERY {
+		bytes, err = t.query(stub, spec, args)
+	} else {
+		bytes, err = t.invoke(stub, spec, args)
+	}
+
+	if err != nil { fmt.Printf("CALL: %s failed: %s", function, err); return nil, as_chaincode_error(err) }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  invoke and query -- check the caller and the arguments against the FunctionSpec and run it
+//=================================================================================================
+
+func (t *SimpleChainCode) invoke(stub shim.ChaincodeStubInterface, spec FunctionSpec, args[] string) ([]byte, error) {
 	
-	bytes, err := json.Marshal(imeiIds);
+	caller, callerAffiliation, err := t.get_caller_data(stub)
 	
-	if err != nil { return nil, errors.New("Error creating IMEI_Holder record") }
+	if err != nil { fmt.Printf("INVOKE: Error retrieving caller information: %s", err); return nil, permission_denied("Error retrieving caller information") }
 	
-	err = stub.PutState("imeiIds", bytes)
+	fmt.Printf("INVOKE: %s called by %s (%s)", spec.Name, caller, callerAffiliation)
 	
-	return nil, err
-	 
-} 
-
-func (t *SimpleChainCode) Invoke(stub shim.ChaincodeStubInterface, function string, args[] string) ([]byte, error) {
+	args, err = spec.check_call(callerAffiliation, args)
 	
-	if function == "create_device" && len(args) == 1 {
-		return	t.createDevice(stub, args[0])
-	} else if function == "create_device" && len(args) > 1 {
-		if len(args) != 4 {fmt.Printf("Incorrect input data passed. Cannot process creation"); return nil, errors.New("Invalid input arguments for device creation")} 
-		return	t.createDeviceUsingForm(stub, args)
-	} else {
-		d, err := t.get_device(stub, args[0])
-		
-		if err != nil { fmt.Printf("error retrieving device details"); return nil, errors.New("error retrieving device details")}
-		
-		if function == "TRF_TO_WH" { return t.tranfer_to_WareHouse(stub, d, "VENDOR", args[1], args[2], "WAREHOUSE")
-		} else if function == "ACPT_FROM_VENDOR" { return t.accept_from_vendor(stub, d, "WAREHOUSE", args[1], "WAREHOUSE")
-		} else if function == "TRF_TO_STRE" { return t.tranfer_to_store(stub, d, "WAREHOUSE", args[1], args[2], "STORE")
-		} else if function == "ACPT_FROM_WAREHOUSE" { return t.accept_from_warehouse(stub, d, "STORE", args[1], "STORE")	
-		} else if function == "TRF_TO_CUST" { return t.tranfer_to_customer(stub, d, "STORE", args[1], args[2], "STORE")
-		} else if function == "RTN_FROM_CUST" { return t.return_from_customer(stub, d, "STORE", args[1], "STORE")					
-		} else if function == "EXCHANGE_DEV" { 
-			oldDev, err := t.get_device(stub, args[2])
-			if err != nil {fmt.Printf("unable to get old device"); return nil, errors.New("Unable to return old device")}
-			return t.exchange_device(stub, oldDev, d, "STORE", args[1], "STORE")
-		} else if function == "RTN_TO_WAREHOUSE" { return t.return_to_warehouse(stub, d, "STORE", args[1], args[2], "WAREHOUSE")
-		} else if function == "ACPT_FROM_STRE" { return t.return_from_store(stub, d, "WAREHOUSE", args[1], "WAREHOUSE")		
-		} else if function == "RTN_TO_VENDOR" { return t.return_to_vendor(stub, d, "WAREHOUSE", args[1], args[2], "VENDOR")
-		} else if function == "ACPT_RTN_FROM_WAREHOUSE" { return t.return_from_warehouse(stub, d, "VENDOR", args[1], "VENDOR")		
-		} 
-	}		
-	return nil, nil
-}
-
-func (t *SimpleChainCode) Query(stub shim.ChaincodeStubInterface, function string, args[] string) ([]byte, error) {
+	if err != nil { return nil, err }
 	
-	if function == "get_device_details" {
-		d, err := t.get_device(stub, args[0])
-		if err != nil { fmt.Printf("error retrieving device details"); return nil, errors.New("error retrieving device details")}
-		return t.get_dev_details(stub, d)
-	}  else if function == "check_unique_imei" {
-		return t.check_unique_imei(stub, args[0])
-	} else if function == "get_devices" {
-		return t.get_devices(stub)
-	}
-	return nil, nil
+	return spec.run(t, stub, callerAffiliation, args)
 }
 
-func (t *SimpleChainCode) createDevice(stub shim.ChaincodeStubInterface, imeiId string) ([]byte, error) {
+func (t *SimpleChainCode) query(stub shim.ChaincodeStubInterface, spec FunctionSpec, args[] string) ([]byte, error) {
 	
-	var d Device
 	var err error
-	var IMEI_Ids IMEI_Holder
-	
-	DeviceName  := "\"deviceName\":\"LENOVO\", "
-	DeviceModel := "\"devicemodel\":\"VIBE\", "
-	DateOfManf  := "\"dateofmanf\":\"''03-12-2016''\" , "
-	DateOfSale  := "\"dateofsale\":\"UNDEFINED\", "
-	OldIMEI     := "\"oldimei\":\"UNDEFINED\", "
-	IMEI_ID     := "\"imei\":\""+imeiId+"\", "
-	Status     	:= "\"status\":\"CREATED\", "
-	SoldBy     	:= "\"soldby\":\"UNDEFINED\", "
-	Owner     	:= "\"owner\":\"VENDOR\" "
 	
-	json_device := " {" +DeviceName+DeviceModel+DateOfManf+DateOfSale+OldIMEI+IMEI_ID+Status+SoldBy+Owner+"} "
+	callerAffiliation := ""
 	
-	if imeiId == "" {
-		fmt.Printf("Invalid device ID")
+	if spec.NeedsCaller || len(spec.Roles) > 0 {
+		_, callerAffiliation, err = t.get_caller_data(stub)
+		if err != nil { return nil, permission_denied("Error retrieving caller information") }
 	}
 	
-	err = json.Unmarshal([]byte(json_device), &d)
-	
-	record, err := stub.GetState(d.IMEI)
-	
-	if record != nil { return nil, errors.New("Device already exists") }
+	args, err = spec.check_call(callerAffiliation, args)
 	
-	_, err = t.save_changes(stub, d)
+	if err != nil { return nil, err }
 	
-	if err != nil { fmt.Printf("CREATEDEVICE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	return spec.run(t, stub, callerAffiliation, args)
+}
 
-	bytes, err := stub.GetState("imeiIds")
+//=================================================================================================
+//  DeviceSpec -- the fields a vendor supplies when registering a device. Anything else in a JSON
+//  creation request is rejected; status, owner and dates are set by the chaincode.
+//=================================================================================================
 
-	if err != nil { return nil, errors.New("Unable to get imeiIds") }
+type DeviceSpec struct {
+	IMEI        string `json:"imei"`
+	DeviceName  string `json:"devicename"`
+	DeviceModel string `json:"devicemodel"`
+	DateOfManf  string `json:"dateofmanf"`
+}
 
-	
+//=================================================================================================
+//  createDevice -- creates a device from a JSON DeviceSpec
+//=================================================================================================
 
-	err = json.Unmarshal(bytes, &IMEI_Ids)
+func (t *SimpleChainCode) createDevice(stub shim.ChaincodeStubInterface, spec string) ([]byte, error) {
 
-	if err != nil {	return nil, errors.New("Corrupt IMEI_Holder record") }
+	var ds DeviceSpec
 
-	IMEI_Ids.IMEIs = append(IMEI_Ids.IMEIs, imeiId)
+	decoder := json.NewDecoder(strings.NewReader(spec))
+	decoder.DisallowUnknownFields()
 
-	bytes, err = json.Marshal(IMEI_Ids)
+	err := decoder.Decode(&ds)
 
-	if err != nil { fmt.Printf("Error creating IMEI_Holder record") }
+	if err != nil { fmt.Printf("CREATEDEVICE: Invalid device specification: %s", err); return nil, validation_failed("Invalid device specification: %s", err) }
 
-	err = stub.PutState("imeiIds", bytes)
+	if decoder.More() { return nil, validation_failed("Invalid device specification: trailing data") }
 
-	if err != nil { return nil, errors.New("Unable to put the state") }
+	return t.register_device(stub, ds)
+}
 
-	return nil, nil
+//=================================================================================================
+//  createDeviceUsingForm -- creates a device from the form fields imei, name, model, dateofmanf
+//=================================================================================================
 
+func (t *SimpleChainCode) createDeviceUsingForm(stub shim.ChaincodeStubInterface, args[] string) ([]byte, error) {
+
+	return t.register_device(stub, DeviceSpec{IMEI: args[0], DeviceName: args[1], DeviceModel: args[2], DateOfManf: args[3]})
 }
 
+//=================================================================================================
+//  new_device -- validates a DeviceSpec and returns the Device it describes in status CREATED
+//=================================================================================================
+
+func (t *SimpleChainCode) new_device(stub shim.ChaincodeStubInterface, ds DeviceSpec) (Device, error) {
 
-func (t *SimpleChainCode) createDeviceUsingForm(stub shim.ChaincodeStubInterface, args[] string) ([]byte, error) {
-	
 	var d Device
-	var err error
-	var IMEI_Ids IMEI_Holder
-	var imeiId string
-	
-	imeiId = args[0]
-	
-	DeviceName  := "\"deviceName\":\""+args[1]+"\", "
-	DeviceModel := "\"devicemodel\":\""+args[2]+"\", "
-	DateOfManf  := "\"dateofmanf\":\"''"+args[3]+"''\" , "
-	DateOfSale  := "\"dateofsale\":\"UNDEFINED\", "
-	OldIMEI     := "\"oldimei\":\"UNDEFINED\", "
-	IMEI_ID     := "\"imei\":\""+imeiId+"\", "
-	Status     	:= "\"status\":\"CREATED\", "
-	SoldBy     	:= "\"soldby\":\"UNDEFINED\", "
-	Owner     	:= "\"owner\":\"VENDOR\" "
-	
-	json_device := " {" +DeviceName+DeviceModel+DateOfManf+DateOfSale+OldIMEI+IMEI_ID+Status+SoldBy+Owner+"} "
-	
-	if imeiId == "" {
-		fmt.Printf("Invalid device ID")
-	}
-	
-	err = json.Unmarshal([]byte(json_device), &d)
-	
-	record, err := stub.GetState(d.IMEI)
-	
-	if record != nil { return nil, errors.New("Device already exists") }
-	
-	_, err = t.save_changes(stub, d)
-	
-	if err != nil { fmt.Printf("CREATEDEVICE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 
-	bytes, err := stub.GetState("imeiIds")
+	info, err := parse_imei(ds.IMEI)
 
-	if err != nil { return nil, errors.New("Unable to get imeiIds") }
+	if err != nil { return d, err }
 
-	
+	if strings.TrimSpace(ds.DeviceName) == "" { return d, validation_failed("Device name is required") }
+	if strings.TrimSpace(ds.DeviceModel) == "" { return d, validation_failed("Device model is required") }
 
-	err = json.Unmarshal(bytes, &IMEI_Ids)
+	err = t.check_tac(stub, info.TAC, strings.TrimSpace(ds.DeviceName), strings.TrimSpace(ds.DeviceModel))
 
-	if err != nil {	return nil, errors.New("Corrupt IMEI_Holder record") }
+	if err != nil { return d, err }
 
-	IMEI_Ids.IMEIs = append(IMEI_Ids.IMEIs, imeiId)
+	manf, err := parse_ledger_time(ds.DateOfManf)
 
-	bytes, err = json.Marshal(IMEI_Ids)
+	if err != nil || manf.IsZero() { return d, validation_failed("Invalid date of manufacture %s", ds.DateOfManf) }
 
-	if err != nil { fmt.Printf("Error creating IMEI_Holder record") }
+	now, err := t.tx_time(stub)
 
-	err = stub.PutState("imeiIds", bytes)
+	if err != nil { return d, err }
 
-	if err != nil { return nil, errors.New("Unable to put the state") }
+	party, err := t.get_party(stub)
 
-	return nil, nil
+	if err != nil { return d, err }
 
-}
+	if manf.After(now.Time) { return d, validation_failed("Date of manufacture %s is in the future", ds.DateOfManf) }
+
+	d.IMEI        = info.IMEI
+	d.SVN         = info.SVN
+	d.DeviceName  = strings.TrimSpace(ds.DeviceName)
+	d.DeviceModel = strings.TrimSpace(ds.DeviceModel)
+	d.DateOfManf  = manf
+	d.OldIMEI     = "UNDEFINED"
+	d.Status      = STATUS_CREATED
+	d.Owner       = VENDOR
+	d.OwnerID     = party
+	d.CreatedBy   = party
 
+	return d, nil
+}
 
 //=================================================================================================
-//  save_changes -- This function is used to save the updates of device
+//  register_device -- validates and stores a new device and returns it
 //=================================================================================================
 
-func (t *SimpleChainCode) save_changes(stub shim.ChaincodeStubInterface, d Device) (bool, error) {
+func (t *SimpleChainCode) register_device(stub shim.ChaincodeStubInterface, ds DeviceSpec) ([]byte, error) {
 
-	bytes, err := json.Marshal(d)
+	d, err := t.new_device(stub, ds)
 
-	if err != nil { fmt.Printf("SAVE_CHANGES: Error converting Device record: %s", err); return false, errors.New("Error converting Device record") }
+	if err != nil { fmt.Printf("CREATEDEVICE: %s", err); return nil, err }
 
-	err = stub.PutState(d.IMEI, bytes)
+	exists, err := t.device_exists(stub, d.IMEI)
 
-	if err != nil { fmt.Printf("SAVE_CHANGES: Error storing device record: %s", err); return false, errors.New("Error storing device record") }
+	if err != nil { return nil, err }
 
-	return true, nil
-}
+	if exists { return nil, duplicate_imei(d.IMEI) }
 
-//=========================================================================================================================
-//  get_device method is used to retrive device data
-//=========================================================================================================================
+	err = t.store_new_device(stub, d)
 
-func (t *SimpleChainCode) get_device(stub shim.ChaincodeStubInterface, imeiId string) (Device, error) {
-	  var dev Device
-	  bytes, err := stub.GetState(imeiId)
-	  if err != nil { fmt.Printf("error while retrieving device"); return dev, errors.New("error retrieving device") }
-	  err = json.Unmarshal(bytes, &dev)
-	  if err != nil {fmt.Printf("failed to convert device data"); return dev, errors.New("error unmarshalling data") }
-	  return dev, nil
-}
+	if err != nil { return nil, err }
 
-func (t *SimpleChainCode) get_dev_details(stub shim.ChaincodeStubInterface, device Device) ([]byte, error){
-	
-	
-	bytes, err := json.Marshal(device)
-	
-	if err != nil { return nil, errors.New("Invalid device object") }
-	
-//	if device.Owner  == caller {
-		return bytes, nil
-//	} else {
-//		return nil, errors.New("Permission denied: could not return device details");
-//	}
-	
+	return t.get_dev_details(Reader{Affiliation: VENDOR}, d)
 }
 
-func (t *SimpleChainCode) check_unique_imei(stub shim.ChaincodeStubInterface, imei string) ([]byte, error) {
-	_, err := t.get_device(stub, imei)
-	if err == nil {
-		return []byte("false"), errors.New("IMEI is not unique")
-	} else {
-		return []byte("true"), nil
-	}
-}
+//=================================================================================================
+//  store_new_device -- saves a validated device and opens its custody chain
+//=================================================================================================
 
-func (t *SimpleChainCode) get_devices(stub shim.ChaincodeStubInterface) ([]byte, error) {
-	bytes, err := stub.GetState("imeiIds")
+func (t *SimpleChainCode) store_new_device(stub shim.ChaincodeStubInterface, d Device) error {
 
-	if err != nil { return nil, errors.New("Unable to get imeiIds") }
+	_, err := t.save_changes(stub, d)
 
-	var imeiIDs IMEI_Holder
+	if err != nil { fmt.Printf("CREATEDEVICE: Error saving changes: %s", err); return errors.New("Error saving changes") }
 
-	err = json.Unmarshal(bytes, &imeiIDs)
+	now, err := t.tx_time(stub)
 
-	if err != nil {	return nil, errors.New("Corrupt IMEI_Holder") }
+	if err != nil { return err }
 
-	result := "["
+	return t.append_history(stub, CustodyEvent{IMEI: d.IMEI, Function: "create_device", ToParty: d.Owner, StatusAfter: d.Status, Timestamp: now})
+}
 
-	var temp []byte
-	var dev Device
+//=================================================================================================
+//  save_changes -- This function is used to save the updates of device and its index entries
+//=================================================================================================
 
-	for _, imei := range imeiIDs.IMEIs {
+func (t *SimpleChainCode) save_changes(stub shim.ChaincodeStubInterface, d Device) (bool, error) {
 
-		dev, err = t.get_device(stub, imei)
+	var previous *Device
 
-		if err != nil {return nil, errors.New("Failed to retrieve IMEI")}
+	key, err := device_key(stub, d.IMEI)
 
-		temp, err = t.get_dev_details(stub, dev)
+	if err != nil { return false, err }
 
-		if err == nil {
-			result += string(temp) + ","
-		}
-	}
+	bytes, err := stub.GetState(key)
 
-	if len(result) == 1 {
-		result = "[]"
-	} else {
-		result = result[:len(result)-1] + "]"
+	if err != nil { fmt.Printf("SAVE_CHANGES: Error reading device record: %s", err); return false, errors.New("Error reading device record") }
+
+	if bytes != nil {
+		previous = new(Device)
+		err = json.Unmarshal(bytes, previous)
+		if err != nil { fmt.Printf("SAVE_CHANGES: Error converting previous Device record: %s", err); return false, errors.New("Error converting Device record") }
 	}
 
-	return []byte(result), nil
-}
+	err = t.update_indexes(stub, previous, d)
 
+	if err != nil { return false, err }
 
-func (t *SimpleChainCode) tranfer_to_WareHouse(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, consignNumber string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "VENDOR" &&
-		recipientAffiliation == "WAREHOUSE" &&
-		dev.Status == "CREATED"	  {
-		fmt.Printf(" tranfer_to_WareHouse :: data set"); 
-			dev.Status = "DELIVERED_TO_WAREHOUSE"
-			dev.DateOfDelivery = time.Now().String();
-			dev.ConsignmentNumber = consignNumber
-	} else {
-		fmt.Printf(" tranfer_to_WareHouse :: Permission denied"); 
-		return nil, errors.New("error while updating device status to Delivered to warehouse"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on transfer to warehouse")}
-	fmt.Printf(" tranfer_to_WareHouse :: completed"); 
-	return nil, nil
-}
+	bytes, err = json.Marshal(d)
 
-func (t *SimpleChainCode) accept_from_vendor(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "WAREHOUSE" &&
-		recipientAffiliation == "WAREHOUSE" &&
-		dev.Owner == "VENDOR" && 
-		dev.Status == "DELIVERED_TO_WAREHOUSE"	  {
-		fmt.Printf(" accept_from_vendor"); 
-			dev.Status = "Received"
-			dev.Owner = "WAREHOUSE"
-			dev.DateOfReceipt = time.Now().String();
-	} else {
-		fmt.Printf(" tranfer_to_WareHouse :: Permission denied"); 
-		return nil, errors.New("error while receiving device at warehouse"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details while accept from warehouse")}
-	fmt.Printf(" accept_from_vendor :: completed"); 
-	return nil, nil
-}
+	if err != nil { fmt.Printf("SAVE_CHANGES: Error converting Device record: %s", err); return false, errors.New("Error converting Device record") }
 
-func (t *SimpleChainCode) tranfer_to_store(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, consignNumber string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "WAREHOUSE" &&
-		recipientAffiliation == "STORE" &&
-		dev.Status == "Received"	  {
-		fmt.Printf(" tranfer_to_store :: data set"); 
-			dev.Status = "DELIVERED_TO_STORE"
-			dev.DateOfDelivery = time.Now().String()
-			dev.ConsignmentNumber = consignNumber 
-	} else {
-		fmt.Printf(" tranfer_to_store :: Permission denied"); 
-		return nil, errors.New("error while updating device status to Delivered to store"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on transfer to store")}
-	fmt.Printf(" tranfer_to_store :: completed"); 
-	return nil, nil
-}
+	err = stub.PutState(key, bytes)
 
-func (t *SimpleChainCode) accept_from_warehouse(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "STORE" &&
-		recipientAffiliation == "STORE" &&
-		dev.Owner == "WAREHOUSE" &&
-		dev.Status == "DELIVERED_TO_STORE"	  {
-		fmt.Printf(" accept_from_warehouse :: data set"); 
-			dev.Status = "Received"
-			dev.Owner = "STORE"
-			dev.DateOfReceipt = time.Now().String()
-			
-	} else {
-		fmt.Printf(" accept from warehouse :: Permission denied"); 
-		return nil, errors.New("error while updating device status to received by store"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on accept from warehouse")}
-	fmt.Printf(" accept_from_warehouse :: completed"); 
-	return nil, nil
-}
+	if err != nil { fmt.Printf("SAVE_CHANGES: Error storing device record: %s", err); return false, errors.New("Error storing device record") }
 
-func (t *SimpleChainCode) tranfer_to_customer(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, callerName string, recipientName string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "STORE" &&
-		recipientAffiliation == "STORE" &&
-		dev.Owner == "STORE" &&
-		dev.Status == "Received"	  {
-		fmt.Printf(" tranfer_to_store :: data set"); 
-			dev.Status = "DELIVERED_TO_CUSTOMER"
-			dev.DateOfSale = time.Now().String()
-			dev.SoldBy = callerName
-			dev.Owner = recipientName
-			
-	} else {
-		fmt.Printf(" tranfer_to_customer :: Permission denied"); 
-		return nil, errors.New("error while updating device status to Delivered to customer"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on transfer to customer")}
-	fmt.Printf(" tranfer_to_customer :: completed"); 
-	return nil, nil
+	return true, nil
 }
 
-func (t *SimpleChainCode) return_from_customer(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "STORE" &&
-		recipientAffiliation == "STORE" &&
-		dev.Owner == "CUSTOMER" &&
-		dev.Status == "DELIVERED_TO_CUSTOMER"	  {
-		fmt.Printf(" tranfer_to_store :: data set"); 
-			dev.Status = "RETURNED_TO_STORE"
-			dev.DateOfReceipt = time.Now().String()
-			dev.Owner = recipientName
-	} else {
-		fmt.Printf(" return_from_customer :: Permission denied"); 
-		return nil, errors.New("error while updating device status to return from customer"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on return from customer")}
-	fmt.Printf(" return from customer :: completed"); 
-	return nil, nil
-}
+//=========================================================================================================================
+//  get_device method is used to retrive device data
+//=========================================================================================================================
 
-func (t *SimpleChainCode) exchange_device(stub shim.ChaincodeStubInterface, oldDev Device, dev Device, callerAffliation string, recipientName string, recipientAffiliation string) ([]byte, error) {
-	fmt.Printf("callerAffliation :: " + callerAffliation);
-	fmt.Printf("recipientAffiliation :: " + recipientAffiliation);
-	fmt.Printf("oldDev.Owner :: " + oldDev.Owner);
-	fmt.Printf("oldDev.Status :: " + oldDev.Status);
-	fmt.Printf("dev.Status :: " + dev.Status);
-	fmt.Printf("oldDev.DeviceModel :: " + oldDev.DeviceModel);
-	fmt.Printf("dev.DeviceModel :: " + dev.DeviceModel);
-	fmt.Printf("model compare result :: " )
-	fmt.Println(oldDev.DeviceModel == dev.DeviceModel);
-	
-	if  callerAffliation == "STORE" &&
-		recipientAffiliation == "STORE" &&
-		oldDev.Owner == "STORE" &&
-		oldDev.Status == "RETURNED_TO_STORE" &&
-		dev.Status == "Received" &&
-		oldDev.DeviceModel == dev.DeviceModel	  {
-		fmt.Printf(" exchange device :: data set"); 
-			dev.Status = "Exchanged"
-			dev.DateOfSale = time.Now().String()
-			dev.Owner = recipientName
-			dev.OldIMEI=oldDev.IMEI
-	} else {
-		fmt.Printf(" return_from_customer :: Permission denied"); 
-		return nil, errors.New("error while updating device status to return from customer"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on return from customer")}
-	fmt.Printf(" return from customer :: completed"); 
-	return nil, nil
+func (t *SimpleChainCode) get_device(stub shim.ChaincodeStubInterface, imeiId string) (Device, error) {
+	  var dev Device
+	  key, err := device_key(stub, imeiId)
+	  if err != nil { return dev, device_not_found(imeiId) }
+	  bytes, err := stub.GetState(key)
+	  if err != nil { fmt.Printf("error while retrieving device"); return dev, errors.New("error retrieving device") }
+	  if bytes == nil {
+		  // not yet moved by migrate_imei_index
+		  bytes, err = stub.GetState(imeiId)
+		  if err != nil { fmt.Printf("error while retrieving device"); return dev, errors.New("error retrieving device") }
+	  }
+	  if bytes == nil { return dev, device_not_found(imeiId) }
+	  err = json.Unmarshal(bytes, &dev)
+	  if err != nil {fmt.Printf("failed to convert device data"); return dev, errors.New("error unmarshalling data") }
+	  return dev, nil
 }
 
+//=========================================================================================================================
+//  device_exists -- reports whether a device is stored under the IMEI, in either key layout
+//=========================================================================================================================
 
-func (t *SimpleChainCode) return_to_warehouse(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, consignNumber string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "STORE" &&
-		recipientAffiliation == "WAREHOUSE" &&
-		dev.Owner == "STORE" &&
-		dev.Status == "RETURNED_TO_STORE"	  {
-		fmt.Printf(" return_to_warehouse :: data set"); 
-			dev.Status = "RETURNED_TO_WAREHOUSE"
-			dev.DateOfDelivery = time.Now().String()
-			dev.ConsignmentNumber = consignNumber
-	} else {
-		fmt.Printf(" return_to_warehouse :: Permission denied"); 
-		return nil, errors.New("error while updating device status to return_to_warehouse"); 
+func (t *SimpleChainCode) device_exists(stub shim.ChaincodeStubInterface, imeiId string) (bool, error) {
+	composite, err := device_key(stub, imeiId)
+	if err != nil { return false, nil }
+	for _, key := range []string{composite, imeiId} {
+		record, err := stub.GetState(key)
+		if err != nil { return false, errors.New("Unable to check device " + imeiId) }
+		if record != nil { return true, nil }
 	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on return_to_warehouse")}
-	fmt.Printf(" return_to_warehouse :: completed"); 
-	return nil, nil
+	return false, nil
 }
 
-func (t *SimpleChainCode) return_from_store(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "WAREHOUSE" &&
-		recipientAffiliation == "WAREHOUSE" &&
-		dev.Owner == "STORE" &&
-		dev.Status == "RETURNED_TO_WAREHOUSE"	  {
-		fmt.Printf(" return_from_store :: data set"); 
-			dev.Status = "Received"
-			dev.DateOfReceipt = time.Now().String()
-			dev.Owner = "WAREHOUSE"
-	} else {
-		fmt.Printf(" return_from_store :: Permission denied"); 
-		return nil, errors.New("error while updating device status to return_from_store"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on return_from_store")}
-	fmt.Printf(" return_from_store :: completed"); 
-	return nil, nil
-}
+//=========================================================================================================================
+//  check_unique_imei -- "true" if no device is stored under the IMEI, "false" if one is. Either is a valid answer;
+//  only a failure to read the ledger is an error. An IMEISV is checked as the IMEI it contains.
+//=========================================================================================================================
 
-func (t *SimpleChainCode) return_to_vendor(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, consignNumber string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "WAREHOUSE" &&
-		recipientAffiliation == "VENDOR" &&
-		dev.Owner == "WAREHOUSE" &&
-		dev.Status == "Received"	  {
-		fmt.Printf(" return_to_vendor :: data set"); 
-			dev.Status = "RETURNED_TO_VENDOR"
-			dev.DateOfDelivery = time.Now().String()
-			dev.ConsignmentNumber = consignNumber
-	} else {
-		fmt.Printf(" return_to_vendor :: Permission denied"); 
-		return nil, errors.New("error while updating device status to return from customer"); 
-	}
-	
-	_, err := t.save_changes(stub, dev)
-	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on return_to_vendor")}
-	fmt.Printf(" return_to_vendor :: completed"); 
-	return nil, nil
+func (t *SimpleChainCode) check_unique_imei(stub shim.ChaincodeStubInterface, imei string) ([]byte, error) {
+	if info, err := parse_imei(imei); err == nil { imei = info.IMEI }
+	exists, err := t.device_exists(stub, imei)
+	if err != nil { return nil, err }
+	if exists { return []byte("false"), nil }
+	return []byte("true"), nil
 }
 
-func (t *SimpleChainCode) return_from_warehouse(stub shim.ChaincodeStubInterface, dev Device, callerAffliation string, recipientName string, recipientAffiliation string) ([]byte, error) {
-	if  callerAffliation == "VENDOR" &&
-		recipientAffiliation == "VENDOR" &&
-		dev.Owner == "WAREHOUSE" &&
-		dev.Status == "RETURNED_TO_VENDOR"	  {
-		fmt.Printf(" return_from_warehouse :: data set"); 
-			dev.Status = "Received"
-			dev.DateOfDelivery = time.Now().String()
-			dev.Owner = "VENDOR"
-	} else {
-		fmt.Printf(" return_from_warehouse :: Permission denied"); 
-		return nil, errors.New("error while updating device status to return_from_warehouse"); 
-	}
+func main() {
 	
-	_, err := t.save_changes(stub, dev)
+	chaincode, err := contractapi.NewChaincode(new_device_contract())
 	
-	if err != nil {fmt.Printf("error while updating the status"); return nil, errors.New("error saving device details on return_from_warehouse")}
-	fmt.Printf(" return_from_warehouse :: completed"); 
-	return nil, nil
-}
-
-func main() {
+	if err != nil { fmt.Println("error while creating chaincode: " + err.Error()); return }
+	
+	chaincode.Info.Title = "SupplyChainDevice"
+	chaincode.Info.Version = CONTRACT_VERSION
 	
-	err := shim.Start(new(SimpleChainCode));
+	err = chaincode.Start()
 	
-	if err != nil { fmt.Println("error while starting shim code"); 
+	if err != nil { fmt.Println("error while starting chaincode: " + err.Error()); 
 	} else {
 		fmt.Println("chaincode started");
 	}
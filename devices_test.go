@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCreateDevice(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	cases := []struct {
+		Name string
+		Args func(imei string) []string
+		Code string
+	}{
+		{"form", func(imei string) []string { return []string{imei, "LENOVO", "VIBE", "2016-12-03"} }, ""},
+		{"json", func(imei string) []string {
+			return []string{`{"imei":"` + imei + `","devicename":"LENOVO","devicemodel":"VIBE","dateofmanf":"2016-12-03"}`}
+		}, ""},
+		{"default template", func(imei string) []string { return []string{imei} }, ""},
+		{"imeisv", func(imei string) []string { return []string{imei[:14] + "07", "LENOVO", "VIBE", "2016-12-03"} }, ""},
+		{"bad check digit", func(imei string) []string { return []string{imei[:14] + "0", "LENOVO", "VIBE", "2016-12-03"} }, ERR_VALIDATION_FAILED},
+		{"no model", func(imei string) []string { return []string{imei, "LENOVO", " ", "2016-12-03"} }, ERR_VALIDATION_FAILED},
+		{"bad date", func(imei string) []string { return []string{imei, "LENOVO", "VIBE", "yesterday"} }, ERR_VALIDATION_FAILED},
+		{"future date", func(imei string) []string { return []string{imei, "LENOVO", "VIBE", "2999-01-01"} }, ERR_VALIDATION_FAILED},
+		{"unknown json field", func(imei string) []string { return []string{`{"imei":"` + imei + `","status":"SOLD"}`} }, ERR_VALIDATION_FAILED},
+		{"two arguments", func(imei string) []string { return []string{imei, "LENOVO"} }, ERR_VALIDATION_FAILED},
+	}
+
+	for i, c := range cases {
+		imei := test_imei(i + 1)
+		if c.Code == "" {
+			l.must("create_device", c.Args(imei)...)
+			if d := l.device(imei); d.Status != STATUS_CREATED || d.Owner != VENDOR { t.Errorf("%s: created %+v", c.Name, d) }
+		} else {
+			l.fails(c.Code, "create_device", c.Args(imei)...)
+		}
+	}
+
+	l.fails(ERR_DUPLICATE_IMEI, "create_device", test_imei(1), "LENOVO", "VIBE", "2016-12-03")
+
+	for _, role := range []string{WAREHOUSE, STORE, CUSTOMER} {
+		l.as(role).fails(ERR_PERMISSION_DENIED, "create_device", test_imei(99), "LENOVO", "VIBE", "2016-12-03")
+	}
+}
+
+func TestTemplatesAndTACs(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	l.must("set_device_template", "moto", "MOTOROLA", "G5", "")
+	l.must("create_device_from_template", test_imei(1), "moto")
+
+	if d := l.device(test_imei(1)); d.DeviceModel != "G5" || d.DateOfManf.IsZero() { t.Errorf("template not applied: %+v", d) }
+
+	l.fails(ERR_NOT_FOUND, "create_device_from_template", test_imei(2), "nokia")
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "set_device_template", "moto", "MOTOROLA", "G6", "")
+
+	l.as(VENDOR).must("register_tac", "35209900", "LENOVO", "VIBE")
+	l.fails(ERR_VALIDATION_FAILED, "create_device", test_imei(3), "MOTOROLA", "G5", "2016-12-03")
+
+	var info IMEI_Info
+	if err := json.Unmarshal([]byte(l.must("decode_imei", test_imei(3))), &info); err != nil { t.Fatal(err) }
+	if info.TAC != "35209900" { t.Errorf("decoded %+v", info) }
+	if err := json.Unmarshal([]byte(l.must("decode_imei", test_imei(3)[:14]+"07")), &info); err != nil || info.SVN != "07" { t.Errorf("decoded %+v", info) }
+}
+
+func TestCreateDevicesBatch(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	csv := "imei,devicename,devicemodel,dateofmanf\n"
+	for i := 1; i <= 3; i++ { csv += fmt.Sprintf("%s,LENOVO,VIBE,2016-12-03\n", test_imei(i)) }
+
+	var report BatchReport
+	if err := json.Unmarshal([]byte(l.must("create_devices_batch", csv)), &report); err != nil { t.Fatal(err) }
+	if report.Created != 3 { t.Errorf("report %+v", report) }
+
+	// one bad row rejects the whole manifest
+	manifest := fmt.Sprintf(`[{"imei":"%s","devicename":"LENOVO","devicemodel":"VIBE","dateofmanf":"2016-12-03"},
+		{"imei":"%s","devicename":"LENOVO","devicemodel":"VIBE","dateofmanf":"2016-12-03"}]`, test_imei(4), test_imei(1))
+
+	ce := l.fails(ERR_VALIDATION_FAILED, "create_devices_batch", manifest, "json")
+
+	details, _ := json.Marshal(ce.Details)
+	if err := json.Unmarshal(details, &report); err != nil || report.Rejected != 1 || report.Rows[1].Error == "" {
+		t.Errorf("report %s", details)
+	}
+
+	if out, _ := l.call("check_unique_imei", test_imei(4)); out != "true" { t.Errorf("row 1 was stored") }
+}
+
+func TestQueries(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	for i := 1; i <= 5; i++ { l.create(i) }
+	l.run_steps(to_vendor_and_back[:2], test_imei(5))
+	l.as(VENDOR)
+
+	l.fails(ERR_DEVICE_NOT_FOUND, "get_device_details", test_imei(9))
+	l.fails(ERR_VALIDATION_FAILED, "get_device_details")
+
+	var page DevicePage
+	if err := json.Unmarshal([]byte(l.must("get_devices", `{"pagesize":2}`)), &page); err != nil { t.Fatal(err) }
+	if !page.More || page.Count != 2 || page.Bookmark != test_imei(3) { t.Errorf("page %+v", page) }
+
+	if err := json.Unmarshal([]byte(l.must("get_devices", `{"pagesize":2,"bookmark":"`+page.Bookmark+`"}`)), &page); err != nil { t.Fatal(err) }
+	if page.Count != 2 || page.Devices[0].IMEI != test_imei(3) { t.Errorf("second page %+v", page) }
+
+	l.fails(ERR_VALIDATION_FAILED, "get_devices", `{"colour":"red"}`)
+
+	var devices []Device
+	if err := json.Unmarshal([]byte(l.must("get_devices_by_owner", WAREHOUSE)), &devices); err != nil { t.Fatal(err) }
+	if len(devices) != 1 || devices[0].IMEI != test_imei(5) { t.Errorf("by owner %+v", devices) }
+
+	if err := json.Unmarshal([]byte(l.must("get_devices_by_status", STATUS_CREATED)), &devices); err != nil { t.Fatal(err) }
+	if len(devices) != 4 { t.Errorf("by status %d devices", len(devices)) }
+
+	if err := json.Unmarshal([]byte(l.must("get_consignment_contents", "C1")), &devices); err != nil { t.Fatal(err) }
+	if len(devices) != 1 { t.Errorf("consignment contents %d devices", len(devices)) }
+
+	// served from the model index, the device of another make is replaced from the next entry
+	l.must("create_device", test_imei(6), "MOTOROLA", "VIBE", "2016-12-03")
+	l.create(7)
+	if err := json.Unmarshal([]byte(l.must("get_devices", `{"pagesize":2,"devicemodel":"VIBE","devicename":"LENOVO","bookmark":"`+test_imei(5)+`"}`)), &page); err != nil { t.Fatal(err) }
+	if page.More || page.Count != 2 || page.Devices[1].IMEI != test_imei(7) || page.Bookmark != "" { t.Errorf("model page %+v", page) }
+
+	// a page stops reading after PAGE_SCAN_FACTOR entries per device asked for, and may come back empty
+	if err := json.Unmarshal([]byte(l.must("get_devices", `{"pagesize":1,"devicename":"MOTOROLA"}`)), &page); err != nil { t.Fatal(err) }
+	if !page.More || page.Count != 0 || page.Bookmark != test_imei(1+PAGE_SCAN_FACTOR) { t.Errorf("partial page %+v", page) }
+	if err := json.Unmarshal([]byte(l.must("get_devices", `{"pagesize":1,"devicename":"MOTOROLA","bookmark":"`+page.Bookmark+`"}`)), &page); err != nil { t.Fatal(err) }
+	if page.Count != 1 || page.Devices[0].IMEI != test_imei(6) || page.Bookmark != test_imei(7) { t.Errorf("next page %+v", page) }
+	if err := json.Unmarshal([]byte(l.must("get_devices", `{"pagesize":1,"devicename":"MOTOROLA","bookmark":"`+page.Bookmark+`"}`)), &page); err != nil { t.Fatal(err) }
+	if page.More || page.Count != 0 || page.Bookmark != "" { t.Errorf("last page %+v", page) }
+
+	var functions []FunctionSpec
+	if err := json.Unmarshal([]byte(l.must("describe_functions")), &functions); err != nil { t.Fatal(err) }
+	if len(functions) != len(registry) { t.Errorf("described %d of %d functions", len(functions), len(registry)) }
+}
+
+func TestMigrations(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	// a device as the original chaincode stored it: under the bare IMEI, listed in imeiIds, with
+	// dates in the Go String() layout
+	imei := test_imei(1)
+	legacy := `{"devicename":"LENOVO","devicemodel":"VIBE","dateofmanf":"2016-12-03 00:00:00 +0000 UTC","consignmentnumber":"",` +
+		`"dateofdelivery":"UNDEFINED","dateofreceipt":"UNDEFINED","dateofsale":"UNDEFINED","oldimei":"UNDEFINED","imei":"` + imei + `",` +
+		`"status":"CREATED","soldby":"UNDEFINED","owner":"VENDOR"}`
+
+	l.begin()
+	l.stub.PutState(imei, []byte(legacy))
+	l.stub.PutState("imeiIds", []byte(`{"imeis":["`+imei+`"]}`))
+	l.end()
+
+	if d := l.device(imei); d.DateOfManf.Year() != 2016 { t.Errorf("legacy record not readable: %+v", d) }
+
+	l.as(WAREHOUSE).fails(ERR_PERMISSION_DENIED, "migrate_dates")
+	l.as(VENDOR)
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "migrate_imei_index")
+	l.as(VENDOR)
+	l.as(CUSTOMER).fails(ERR_PERMISSION_DENIED, "rebuild_indexes")
+	l.as(VENDOR)
+	l.must("migrate_imei_index")
+	l.must("rebuild_indexes")
+	l.must("migrate_dates")
+
+	for _, key := range []string{imei, "imeiIds"} {
+		if l.stub.State[key] != nil { t.Errorf("legacy key %s left behind", key) }
+	}
+
+	key, _ := device_key(l.stub, imei)
+	stored := string(l.stub.State[key])
+	if !strings.Contains(stored, `"dateofmanf":"2016-12-03T00:00:00Z"`) || strings.Contains(stored, `"soldby"`) { t.Errorf("dates not migrated: %s", stored) }
+
+	var devices []Device
+	if err := json.Unmarshal([]byte(l.must("get_devices_by_owner", VENDOR)), &devices); err != nil || len(devices) != 1 { t.Errorf("not indexed: %v", devices) }
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const DISCREPANCY_KEY = "discrepancy"
+
+const (
+	DISCREPANCY_OPEN     = "OPEN"
+	DISCREPANCY_RESOLVED = "RESOLVED"
+)
+
+//=================================================================================================
+//  ScannedDevice -- one device scanned at goods-in. The scan list of ACPT_CONSIGNMENT is either a
+//  JSON array of IMEIs or of these objects when damaged devices have to be reported.
+//=================================================================================================
+
+type ScannedDevice struct {
+	IMEI    string `json:"imei"`
+	Damaged bool   `json:"damaged" metadata:",optional"`
+}
+
+//=================================================================================================
+//  Discrepancy -- a case opened when a consignment arrives short, with damaged devices, with
+//  devices it did not contain or with devices that could not be accepted because they are
+//  Blacklisted. Both the origin and the destination of the consignment can read and resolve it.
+//=================================================================================================
+
+type Discrepancy struct {
+	ID               string     `json:"id"`
+	Consignment      string     `json:"consignment"`
+	Origin           string     `json:"origin"`
+	OriginParty      string     `json:"originparty"`
+	Destination      string     `json:"destination"`
+	DestinationParty string     `json:"destinationparty"`
+	Missing          []string   `json:"missing"`
+	Unexpected       []string   `json:"unexpected"`
+	Damaged          []string   `json:"damaged"`
+	Blacklisted      []string   `json:"blacklisted"`
+	OpenedAt         LedgerTime `json:"openedat"`
+	Status           string     `json:"status"`
+	Resolution       string     `json:"resolution,omitempty"`
+	ResolvedBy       string     `json:"resolvedby,omitempty"`
+	ResolvedAt       LedgerTime `json:"resolvedat"`
+}
+
+func discrepancy_key(stub shim.ChaincodeStubInterface, consignment string, id string) (string, error) {
+	return create_composite_key(stub, DISCREPANCY_KEY, consignment, id)
+}
+
+//=================================================================================================
+//  parse_scan_list -- decodes the scan list of ACPT_CONSIGNMENT, rejecting repeated IMEIs
+//=================================================================================================
+
+func parse_scan_list(value string) ([]ScannedDevice, error) {
+
+	var scanned []ScannedDevice
+
+	imeis, err := parse_imei_list(value)
+
+	if err == nil {
+		for _, imei := range imeis { scanned = append(scanned, ScannedDevice{IMEI: imei}) }
+		return scanned, nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+
+	if decoder.Decode(&scanned) != nil { return nil, validation_failed("Expected a JSON array of IMEIs or of {\"imei\", \"damaged\"} objects") }
+
+	if len(scanned) == 0 { return nil, validation_failed("The IMEI list is empty") }
+
+	seen := make(map[string]bool)
+
+	for i := range scanned {
+		scanned[i].IMEI = strings.TrimSpace(scanned[i].IMEI)
+		if seen[scanned[i].IMEI] { return nil, validation_failed("IMEI %s is listed twice", scanned[i].IMEI) }
+		seen[scanned[i].IMEI] = true
+	}
+
+	return scanned, nil
+}
+
+//=================================================================================================
+//  open_discrepancy -- stores a new case for a consignment, identified by the transaction id
+//=================================================================================================
+
+func (t *SimpleChainCode) open_discrepancy(stub shim.ChaincodeStubInterface, c Consignment, missing []string, unexpected []string, damaged []string, held []string) (Discrepancy, error) {
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return Discrepancy{}, err }
+
+	d := Discrepancy{ID: stub.GetTxID(), Consignment: c.Number, Origin: c.Origin, OriginParty: c.OriginParty,
+		Destination: c.Destination, DestinationParty: c.DestinationParty,
+		Missing: missing, Unexpected: unexpected, Damaged: damaged, Blacklisted: held, OpenedAt: now, Status: DISCREPANCY_OPEN}
+
+	err = t.save_discrepancy(stub, d)
+
+	if err != nil { return d, err }
+
+	fmt.Printf("OPEN_DISCREPANCY: %s on consignment %s: %d missing, %d unexpected, %d damaged, %d blacklisted", d.ID, c.Number, len(missing), len(unexpected), len(damaged), len(held))
+
+	return d, nil
+}
+
+func (t *SimpleChainCode) save_discrepancy(stub shim.ChaincodeStubInterface, d Discrepancy) error {
+
+	bytes, err := json.Marshal(d)
+
+	if err != nil { return errors.New("Error converting discrepancy record") }
+
+	key, err := discrepancy_key(stub, d.Consignment, d.ID)
+
+	if err != nil { return err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("SAVE_DISCREPANCY: Error storing discrepancy %s: %s", d.ID, err); return errors.New("Error storing discrepancy record") }
+
+	return nil
+}
+
+//=================================================================================================
+//  get_discrepancies -- lists the cases opened on a consignment, for its origin or destination
+//=================================================================================================
+
+func (t *SimpleChainCode) get_discrepancies(stub shim.ChaincodeStubInterface, callerAffiliation string, number string) ([]byte, error) {
+
+	c, found, err := t.get_consignment_record(stub, number)
+
+	if err != nil { return nil, err }
+
+	if !found { return nil, not_found("Unknown consignment %s", number) }
+
+	party, err := t.get_party(stub)
+
+	if err != nil { return nil, err }
+
+	if !c.is_origin(callerAffiliation, party) && !c.is_destination(callerAffiliation, party) {
+		return nil, permission_denied("Discrepancies on %s are only visible to %s and %s", number, c.OriginParty, c.DestinationParty)
+	}
+
+	cases := []Discrepancy{}
+
+	err = t.for_each_partial_key(stub, DISCREPANCY_KEY, []string{number}, func(key string, value []byte) (bool, error) {
+
+		var d Discrepancy
+
+		err := json.Unmarshal(value, &d)
+
+		if err != nil { return false, errors.New("Corrupt discrepancy record " + key) }
+
+		cases = append(cases, d)
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	return json.Marshal(cases)
+}
+
+//=================================================================================================
+//  resolve_discrepancy -- closes a case with a free text resolution
+//=================================================================================================
+
+func (t *SimpleChainCode) resolve_discrepancy(stub shim.ChaincodeStubInterface, callerAffiliation string, number string, id string, resolution string) ([]byte, error) {
+
+	var d Discrepancy
+
+	key, err := discrepancy_key(stub, number, id)
+
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return nil, errors.New("Unable to get discrepancy " + id) }
+
+	if bytes == nil { return nil, not_found("Unknown discrepancy %s on consignment %s", id, number) }
+
+	err = json.Unmarshal(bytes, &d)
+
+	if err != nil { return nil, errors.New("Corrupt discrepancy record " + id) }
+
+	party, err := t.get_party(stub)
+
+	if err != nil { return nil, err }
+
+	if !is_party(callerAffiliation, party, d.Origin, d.OriginParty) && !is_party(callerAffiliation, party, d.Destination, d.DestinationParty) {
+		return nil, permission_denied("Discrepancy %s belongs to %s and %s", id, d.OriginParty, d.DestinationParty)
+	}
+
+	if d.Status != DISCREPANCY_OPEN { return nil, validation_failed("Discrepancy %s is already %s", id, d.Status) }
+
+	if strings.TrimSpace(resolution) == "" { return nil, validation_failed("A resolution is required") }
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	d.Status = DISCREPANCY_RESOLVED
+	d.Resolution = resolution
+	d.ResolvedBy = party
+	d.ResolvedAt = now
+
+	err = t.save_discrepancy(stub, d)
+
+	if err != nil { return nil, err }
+
+	return json.Marshal(d)
+}
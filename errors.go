@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//=================================================================================================
+//  Error codes returned to clients. Invoke and Query always fail with a ChaincodeError; its
+//  Error() text is the JSON form, so a client can tell error classes apart without parsing the
+//  message. Anything that is not a ChaincodeError is reported as INTERNAL_ERROR.
+//=================================================================================================
+
+const (
+	ERR_UNKNOWN_FUNCTION   = "UNKNOWN_FUNCTION"
+	ERR_DEVICE_NOT_FOUND   = "DEVICE_NOT_FOUND"
+	ERR_NOT_FOUND          = "NOT_FOUND"
+	ERR_INVALID_TRANSITION = "INVALID_TRANSITION"
+	ERR_PERMISSION_DENIED  = "PERMISSION_DENIED"
+	ERR_DUPLICATE_IMEI     = "DUPLICATE_IMEI"
+	ERR_ALREADY_EXISTS     = "ALREADY_EXISTS"
+	ERR_VALIDATION_FAILED  = "VALIDATION_FAILED"
+	ERR_BLACKLISTED        = "BLACKLISTED"
+	ERR_INTERNAL           = "INTERNAL_ERROR"
+)
+
+// DeviceState is the part of a device a transition is guarded on. An empty Owner matches any owner.
+type DeviceState struct {
+	Status string `json:"status"`
+	Owner  string `json:"owner,omitempty"`
+}
+
+type ChaincodeError struct {
+	Code          string        `json:"code"`
+	Message       string        `json:"message"`
+	IMEI          string        `json:"imei,omitempty"`
+	CurrentState  *DeviceState  `json:"currentstate,omitempty"`
+	ExpectedState []DeviceState `json:"expectedstate,omitempty"`
+	Details       interface{}   `json:"details,omitempty"`
+}
+
+func (e *ChaincodeError) Error() string {
+	bytes, err := json.Marshal(e)
+	if err != nil { return e.Code + ": " + e.Message }
+	return string(bytes)
+}
+
+func new_error(code string, format string, args ...interface{}) *ChaincodeError {
+	return &ChaincodeError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func validation_failed(format string, args ...interface{}) *ChaincodeError {
+	return new_error(ERR_VALIDATION_FAILED, format, args...)
+}
+
+func permission_denied(format string, args ...interface{}) *ChaincodeError {
+	return new_error(ERR_PERMISSION_DENIED, format, args...)
+}
+
+func not_found(format string, args ...interface{}) *ChaincodeError {
+	return new_error(ERR_NOT_FOUND, format, args...)
+}
+
+func device_not_found(imei string) *ChaincodeError {
+	return &ChaincodeError{Code: ERR_DEVICE_NOT_FOUND, Message: "Device " + imei + " does not exist", IMEI: imei}
+}
+
+func duplicate_imei(imei string) *ChaincodeError {
+	return &ChaincodeError{Code: ERR_DUPLICATE_IMEI, Message: "Device " + imei + " already exists", IMEI: imei}
+}
+
+func blacklisted(dev Device) *ChaincodeError {
+	return &ChaincodeError{Code: ERR_BLACKLISTED, Message: "Device " + dev.IMEI + " is reported " + strings.ToLower(dev.Blacklisted), IMEI: dev.IMEI,
+		CurrentState: &DeviceState{Status: dev.Status, Owner: dev.Owner}}
+}
+
+//=================================================================================================
+//  invalid_transition -- the device is not in any of the states the function can be applied in
+//=================================================================================================
+
+func invalid_transition(function string, dev Device, expected []DeviceState) *ChaincodeError {
+	return &ChaincodeError{Code: ERR_INVALID_TRANSITION, IMEI: dev.IMEI,
+		Message:       fmt.Sprintf("%s not allowed for device %s in status %s owned by %s", function, dev.IMEI, dev.Status, dev.Owner),
+		CurrentState:  &DeviceState{Status: dev.Status, Owner: dev.Owner},
+		ExpectedState: expected}
+}
+
+//=================================================================================================
+//  as_chaincode_error -- returns err as a ChaincodeError, classing unknown errors as internal
+//=================================================================================================
+
+func as_chaincode_error(err error) *ChaincodeError {
+	if ce, ok := err.(*ChaincodeError); ok { return ce }
+	return &ChaincodeError{Code: ERR_INTERNAL, Message: err.Error()}
+}
+
+// error_message is the human readable part of an error, for reports that embed several errors
+func error_message(err error) string {
+	if ce, ok := err.(*ChaincodeError); ok { return ce.Message }
+	return err.Error()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  Chaincode events. A transaction can carry a single event, so every invoke that changes devices
+//  emits one DEVICE_LIFECYCLE event listing all of them; consignment functions list one change
+//  per device. The payload layout is part of the interface with off-chain listeners.
+//=================================================================================================
+
+const LIFECYCLE_EVENT = "DEVICE_LIFECYCLE"
+
+type DeviceChange struct {
+	IMEI        string `json:"imei"`
+	Function    string `json:"function"`
+	OldStatus   string `json:"oldstatus"`
+	NewStatus   string `json:"newstatus"`
+	OldOwner    string `json:"oldowner"`
+	NewOwner    string `json:"newowner"`
+	Consignment string `json:"consignment"`
+}
+
+type LifecycleEvent struct {
+	TxID      string         `json:"txid"`
+	Function  string         `json:"function"`
+	Timestamp LedgerTime     `json:"timestamp"`
+	Changes   []DeviceChange `json:"changes"`
+}
+
+//=================================================================================================
+//  emit_lifecycle_event -- sets the transaction's event for the changes made by function
+//=================================================================================================
+
+func (t *SimpleChainCode) emit_lifecycle_event(stub shim.ChaincodeStubInterface, function string, changes []DeviceChange) error {
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return err }
+
+	payload, err := json.Marshal(LifecycleEvent{TxID: stub.GetTxID(), Function: function, Timestamp: now, Changes: changes})
+
+	if err != nil { return errors.New("Error converting lifecycle event") }
+
+	err = stub.SetEvent(LIFECYCLE_EVENT, payload)
+
+	if err != nil { fmt.Printf("EMIT_LIFECYCLE_EVENT: Error setting event: %s", err); return errors.New("Error setting lifecycle event") }
+
+	return nil
+}
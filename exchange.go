@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const EXCHANGE_KEY = "exchange"
+
+// A returned device can be exchanged for this many days after it was sold
+const EXCHANGE_WINDOW_DAYS = 30
+
+const (
+	EXCHANGE_LIKE_FOR_LIKE = "LIKE_FOR_LIKE"
+	EXCHANGE_UPGRADE       = "UPGRADE"
+)
+
+var price_pattern = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+
+//=================================================================================================
+//  Exchange -- the record of one exchange, stored under the IMEI of the returned device. A like
+//  for like exchange hands out the same model at no cost; an upgrade hands out another model and
+//  records the PriceDifference the customer paid, in the store's currency. An exchange that
+//  settles an approved warranty Claim is like for like and is not bound to the exchange window.
+//=================================================================================================
+
+type Exchange struct {
+	OldIMEI         string     `json:"oldimei"`
+	NewIMEI         string     `json:"newimei"`
+	Type            string     `json:"type"`
+	OldModel        string     `json:"oldmodel"`
+	NewModel        string     `json:"newmodel"`
+	PriceDifference string     `json:"pricedifference"`
+	Store           string     `json:"store"`
+	DateOfSale      LedgerTime `json:"dateofsale"`
+	Claim           string     `json:"claim,omitempty"`
+	ExchangedAt     LedgerTime `json:"exchangedat"`
+	TxID            string     `json:"txid"`
+}
+
+// ExchangeSummary -- the redacted view of an Exchange: which devices were exchanged, not where,
+// when or for how much
+type ExchangeSummary struct {
+	OldIMEI  string `json:"oldimei"`
+	NewIMEI  string `json:"newimei"`
+	Type     string `json:"type"`
+	OldModel string `json:"oldmodel"`
+	NewModel string `json:"newmodel"`
+	Redacted bool   `json:"redacted"`
+}
+
+func exchange_key(stub shim.ChaincodeStubInterface, oldimei string) (string, error) {
+	return create_composite_key(stub, EXCHANGE_KEY, oldimei)
+}
+
+//=================================================================================================
+//  check_exchange -- validates the exchange of old for dev at now and returns its record. claim is
+//  the approved warranty claim the exchange settles, if any.
+//=================================================================================================
+
+func check_exchange(kind string, difference string, old Device, dev Device, now LedgerTime, claim string) (Exchange, error) {
+
+	x := Exchange{OldIMEI: old.IMEI, NewIMEI: dev.IMEI, Type: kind, OldModel: old.DeviceModel, NewModel: dev.DeviceModel,
+		PriceDifference: difference, Store: old.OwnerID, DateOfSale: old.DateOfSale, Claim: claim, ExchangedAt: now}
+
+	if old.IMEI == dev.IMEI { return x, validation_failed("Device %s cannot be exchanged for itself", dev.IMEI) }
+
+	if old.ReplacedBy != "" { return x, validation_failed("Device %s was already exchanged for %s", old.IMEI, old.ReplacedBy) }
+
+	if old.DateOfSale.IsZero() { return x, validation_failed("Device %s has no date of sale", old.IMEI) }
+
+	if dev.Refurbished && !old.Refurbished { return x, validation_failed("Device %s is refurbished and cannot replace a new device", dev.IMEI) }
+
+	if claim != "" && kind != EXCHANGE_LIKE_FOR_LIKE { return x, validation_failed("A warranty replacement is like for like") }
+
+	closes := old.DateOfSale.Add(EXCHANGE_WINDOW_DAYS * 24 * time.Hour)
+
+	if claim == "" && now.After(closes) {
+		return x, validation_failed("The exchange window of device %s closed on %s", old.IMEI, LedgerTime{closes})
+	}
+
+	switch kind {
+	case EXCHANGE_LIKE_FOR_LIKE:
+		if dev.DeviceModel != old.DeviceModel {
+			return x, validation_failed("A like for like exchange needs a %s, device %s is a %s", old.DeviceModel, dev.IMEI, dev.DeviceModel)
+		}
+		if difference != "" && strings.Trim(difference, "0.") != "" {
+			return x, validation_failed("A like for like exchange has no price difference")
+		}
+		x.PriceDifference = "0"
+	case EXCHANGE_UPGRADE:
+		if dev.DeviceModel == old.DeviceModel {
+			return x, validation_failed("An upgrade needs a model other than %s", old.DeviceModel)
+		}
+		if !price_pattern.MatchString(difference) {
+			return x, validation_failed("An upgrade needs the price difference as an amount, got %q", difference)
+		}
+	default:
+		return x, validation_failed("Unknown exchange type %s, expected %s or %s", kind, EXCHANGE_LIKE_FOR_LIKE, EXCHANGE_UPGRADE)
+	}
+
+	return x, nil
+}
+
+//=================================================================================================
+//  exchange_device -- hands the customer dev (args[0]) for the device they returned (args[1]);
+//  the customer passed in the transient map must be the one who returned it. Both devices are
+//  updated in the same transaction: dev takes the EXCHANGE_DEV edge and the returned device moves
+//  to the counterpart status, linked to its replacement. dev is sold to the customer for the
+//  price difference, recorded in a SaleRecord like any sale. The warranty of the returned device
+//  ends; a warranty replacement carries on until the returned device's warranty would have
+//  expired and marks its claim REPLACED.
+//=================================================================================================
+
+func (t *SimpleChainCode) exchange_device(stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+
+	kind := strings.ToUpper(strings.TrimSpace(optional_arg(args, 2)))
+	if kind == "" { kind = EXCHANGE_LIKE_FOR_LIKE }
+
+	dev, err := t.get_device(stub, args[0])
+
+	if err != nil { return nil, err }
+
+	tr, err := find_transition("EXCHANGE_DEV", dev)
+
+	if err != nil { return nil, err }
+
+	old, err := t.get_device(stub, args[1])
+
+	if err != nil { return nil, err }
+
+	customer, err := get_customer(stub)
+
+	if err != nil { return nil, err }
+
+	if customer == "" { return nil, validation_failed("EXCHANGE_DEV requires a customer id") }
+
+	owned, err := t.is_customer(stub, old.IMEI, old.ReturnedBy, customer)
+
+	if err != nil { return nil, err }
+
+	if !owned { return nil, permission_denied("Device %s was not returned by the customer named in the exchange", old.IMEI) }
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	var claim WarrantyClaim
+
+	if old.Claim != "" {
+		claim, err = t.get_warranty_claim(stub, old.IMEI, old.Claim)
+		if err != nil { return nil, err }
+		if claim.Status != CLAIM_APPROVED { return nil, validation_failed("Warranty claim %s on device %s is %s", claim.ID, old.IMEI, claim.Status) }
+	}
+
+	x, err := check_exchange(kind, strings.TrimSpace(optional_arg(args, 3)), old, dev, now, claim.ID)
+
+	if err != nil { fmt.Printf("EXCHANGE_DEVICE: %s", err); return nil, err }
+
+	expires, err := t.warranty_expiry(stub, old)
+
+	if err != nil { return nil, err }
+
+	sale := SaleRecord{ID: stub.GetTxID(), IMEI: dev.IMEI, Store: dev.OwnerID, Customer: customer, SalePrice: x.PriceDifference, SoldAt: now}
+
+	saleBytes, err := json.Marshal(sale)
+
+	if err != nil { return nil, errors.New("Error converting sale record") }
+
+	extra := map[string]string{"sale": sale.ID, "salehash": sale_hash(saleBytes)}
+
+	// a warranty replacement keeps the expiry of the returned device instead of a new warranty
+	if claim.ID != "" { extra["warrantyexpires"] = expires.String() }
+
+	change, err := t.run_transition_setting(stub, callerAffiliation, "EXCHANGE_DEV", args[:2], extra)
+
+	if err != nil { return nil, err }
+
+	err = t.put_sale(stub, sale, saleBytes)
+
+	if err != nil { return nil, err }
+
+	if claim.ID != "" {
+		claim.Status = CLAIM_REPLACED
+		claim.Replacement = dev.IMEI
+		claim.Updates = append(claim.Updates, ClaimUpdate{Status: CLAIM_REPLACED, Note: "Exchanged for " + dev.IMEI, By: callerAffiliation, At: now})
+		_, err = t.save_warranty_claim(stub, claim)
+		if err != nil { return nil, err }
+	}
+
+	before := old
+	old.Status = tr.Counterpart.To
+	old.ReplacedBy = dev.IMEI
+	old.Claim = ""
+	if expires.After(now.Time) { old.WarrantyExpires = now }
+
+	_, err = t.save_changes(stub, old)
+
+	if err != nil { fmt.Printf("EXCHANGE_DEVICE: error saving device %s", old.IMEI); return nil, errors.New("error saving device details on EXCHANGE_DEV") }
+
+	err = t.append_history(stub, CustodyEvent{IMEI: old.IMEI, Function: "EXCHANGE_DEV", FromParty: before.Owner, ToParty: old.Owner,
+		StatusBefore: before.Status, StatusAfter: old.Status, Timestamp: now})
+
+	if err != nil { return nil, err }
+
+	x.TxID = stub.GetTxID()
+
+	bytes, err := json.Marshal(x)
+
+	if err != nil { return nil, errors.New("Error converting exchange record") }
+
+	key, err := exchange_key(stub, old.IMEI)
+
+	if err != nil { return nil, err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("EXCHANGE_DEVICE: Error storing exchange %s: %s", old.IMEI, err); return nil, errors.New("Error storing exchange record") }
+
+	err = t.emit_lifecycle_event(stub, "EXCHANGE_DEV", []DeviceChange{change,
+		{IMEI: old.IMEI, Function: "EXCHANGE_DEV", OldStatus: before.Status, NewStatus: old.Status, OldOwner: before.Owner, NewOwner: old.Owner}})
+
+	if err != nil { return nil, err }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  get_exchange -- returns the exchange a device took part in, as the returned or the new device,
+//  or its ExchangeSummary to a reader given the summary of the device
+//=================================================================================================
+
+func (t *SimpleChainCode) get_exchange(stub shim.ChaincodeStubInterface, r Reader, imei string) ([]byte, error) {
+
+	dev, view, err := t.read_device(stub, r, imei)
+
+	if err != nil { return nil, err }
+
+	oldimei := dev.Replaces
+	if dev.ReplacedBy != "" { oldimei = dev.IMEI }
+
+	if oldimei == "" { return nil, not_found("Device %s was not exchanged", imei) }
+
+	key, err := exchange_key(stub, oldimei)
+
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return nil, errors.New("Unable to get exchange of " + oldimei) }
+
+	if bytes == nil { return nil, not_found("No exchange record for device %s", oldimei) }
+
+	if view == VIEW_FULL { return bytes, nil }
+
+	var x Exchange
+
+	err = json.Unmarshal(bytes, &x)
+
+	if err != nil { return nil, errors.New("Corrupt exchange record " + oldimei) }
+
+	return json.Marshal(ExchangeSummary{OldIMEI: x.OldIMEI, NewIMEI: x.NewIMEI, Type: x.Type, OldModel: x.OldModel, NewModel: x.NewModel, Redacted: true})
+}
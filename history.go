@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  CustodyEvent -- one hop in the custody chain of a device. Events are only ever appended to the
+//  device's history record, so earlier hops survive the fields of Device being overwritten.
+//=================================================================================================
+
+type CustodyEvent struct {
+	IMEI         string     `json:"imei"`
+	Function     string     `json:"function"`
+	FromParty    string     `json:"fromparty"`
+	ToParty      string     `json:"toparty"`
+	StatusBefore string     `json:"statusbefore"`
+	StatusAfter  string     `json:"statusafter"`
+	Consignment  string     `json:"consignment"`
+	TxID         string     `json:"txid"`
+	Timestamp    LedgerTime `json:"timestamp"`
+}
+
+//=================================================================================================
+//  Every event is stored under its own key, history~imei~seq~txid, so that appending one does not
+//  rewrite the whole chain; seq keeps the events in order. The head of a device's history holds
+//  the number of events and the last of them, which is all check_hop needs.
+//=================================================================================================
+
+const (
+	HISTORY_INDEX = "history~imei~seq~txid"
+	HISTORY_HEAD  = "historyhead~imei"
+)
+
+// EventSummary -- the redacted view of a CustodyEvent: which transition it was, not who took part
+// in it or when
+type EventSummary struct {
+	IMEI         string `json:"imei"`
+	Function     string `json:"function"`
+	StatusBefore string `json:"statusbefore"`
+	StatusAfter  string `json:"statusafter"`
+	Redacted     bool   `json:"redacted"`
+}
+
+type HistoryHead struct {
+	Count int          `json:"count"`
+	Last  CustodyEvent `json:"last"`
+}
+
+func history_key(stub shim.ChaincodeStubInterface, imei string, seq int, txid string) (string, error) {
+	return create_composite_key(stub, HISTORY_INDEX, imei, fmt.Sprintf("%010d", seq), txid)
+}
+
+func history_head_key(stub shim.ChaincodeStubInterface, imei string) (string, error) {
+	return create_composite_key(stub, HISTORY_HEAD, imei)
+}
+
+//=================================================================================================
+//  get_history_head -- returns the head of a device's history and whether one is stored
+//=================================================================================================
+
+func (t *SimpleChainCode) get_history_head(stub shim.ChaincodeStubInterface, imei string) (HistoryHead, bool, error) {
+
+	var head HistoryHead
+
+	key, err := history_head_key(stub, imei)
+
+	if err != nil { return head, false, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return head, false, errors.New("Unable to get history for " + imei) }
+
+	if bytes == nil { return head, false, nil }
+
+	err = json.Unmarshal(bytes, &head)
+
+	if err != nil { return head, false, errors.New("Corrupt history head for " + imei) }
+
+	return head, true, nil
+}
+
+//=================================================================================================
+//  put_events -- stores events as the entries from seq on of a device's history and moves the
+//  head to the last of them
+//=================================================================================================
+
+func (t *SimpleChainCode) put_events(stub shim.ChaincodeStubInterface, imei string, seq int, events []CustodyEvent) (HistoryHead, error) {
+
+	head := HistoryHead{Count: seq}
+
+	for _, event := range events {
+		bytes, err := json.Marshal(event)
+		if err != nil { fmt.Printf("PUT_EVENTS: Error converting event: %s", err); return head, errors.New("Error converting history record") }
+
+		key, err := history_key(stub, imei, head.Count, event.TxID)
+		if err != nil { return head, err }
+
+		err = stub.PutState(key, bytes)
+		if err != nil { fmt.Printf("PUT_EVENTS: Error storing event: %s", err); return head, errors.New("Error storing history record") }
+
+		head.Count++
+		head.Last = event
+	}
+
+	bytes, err := json.Marshal(head)
+
+	if err != nil { return head, errors.New("Error converting history head") }
+
+	key, err := history_head_key(stub, imei)
+
+	if err != nil { return head, err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("PUT_EVENTS: Error storing history head: %s", err); return head, errors.New("Error storing history record") }
+
+	return head, nil
+}
+
+//=================================================================================================
+//  append_history -- adds an event to the end of the device's custody chain, raising SKIPPED_HOP
+//  if it does not continue from the last one
+//=================================================================================================
+
+func (t *SimpleChainCode) append_history(stub shim.ChaincodeStubInterface, event CustodyEvent) error {
+
+	head, _, err := t.get_history_head(stub, event.IMEI)
+
+	if err != nil { return err }
+
+	if head.Count > 0 {
+		_, err = t.check_hop(stub, head.Last, event)
+		if err != nil { return err }
+	}
+
+	event.TxID = stub.GetTxID()
+
+	_, err = t.put_events(stub, event.IMEI, head.Count, []CustodyEvent{event})
+
+	return err
+}
+
+//=================================================================================================
+//  for_each_event -- calls fn with the key and the event for every event of a device's history,
+//  oldest first
+//=================================================================================================
+
+func (t *SimpleChainCode) for_each_event(stub shim.ChaincodeStubInterface, imei string, fn func(key string, event CustodyEvent) error) error {
+
+	return t.for_each_partial_key(stub, HISTORY_INDEX, []string{imei}, func(key string, value []byte) (bool, error) {
+
+		var event CustodyEvent
+
+		err := json.Unmarshal(value, &event)
+
+		if err != nil { return false, errors.New("Corrupt history record for " + imei) }
+
+		return true, fn(key, event)
+	})
+}
+
+//=================================================================================================
+//  get_history -- returns the custody chain recorded for a single IMEI
+//=================================================================================================
+
+func (t *SimpleChainCode) get_history(stub shim.ChaincodeStubInterface, imei string) ([]CustodyEvent, error) {
+
+	var events []CustodyEvent
+
+	err := t.for_each_event(stub, imei, func(_ string, event CustodyEvent) error {
+		events = append(events, event)
+		return nil
+	})
+
+	if err != nil { return nil, err }
+
+	return events, nil
+}
+
+//=================================================================================================
+//  get_device_history -- returns the full custody chain of a device, oldest first. When the device
+//  was handed out in an exchange the chain of the device it replaced (OldIMEI) comes first. A
+//  reader given the summary of the device only sees the EventSummary of every hop.
+//=================================================================================================
+
+func (t *SimpleChainCode) get_device_history(stub shim.ChaincodeStubInterface, r Reader, imei string) ([]byte, error) {
+
+	_, view, err := t.read_device(stub, r, imei)
+
+	if err != nil { return nil, err }
+
+	var chain []string
+	seen := make(map[string]bool)
+
+	for next := imei; next != "" && next != "UNDEFINED" && !seen[next]; {
+		dev, err := t.get_device(stub, next)
+		if err != nil { fmt.Printf("GET_DEVICE_HISTORY: error retrieving device %s", next); return nil, err }
+
+		seen[next] = true
+		chain = append([]string{next}, chain...)
+		next = dev.OldIMEI
+	}
+
+	events := []CustodyEvent{}
+
+	for _, id := range chain {
+		history, err := t.get_history(stub, id)
+		if err != nil { return nil, err }
+		events = append(events, history...)
+	}
+
+	var bytes []byte
+
+	if view == VIEW_FULL {
+		bytes, err = json.Marshal(events)
+	} else {
+		summaries := []EventSummary{}
+		for _, e := range events {
+			summaries = append(summaries, EventSummary{IMEI: e.IMEI, Function: e.Function, StatusBefore: e.StatusBefore, StatusAfter: e.StatusAfter, Redacted: true})
+		}
+		bytes, err = json.Marshal(summaries)
+	}
+
+	if err != nil { return nil, errors.New("Error converting device history") }
+
+	return bytes, nil
+}
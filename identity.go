@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  Certificate attributes the Fabric CA issues to every enrolled user. "role" holds the
+//  organisation type and is mapped onto the affiliations used by the lifecycle table;
+//  hf.EnrollmentID is set by the CA itself to the id the user enrolled with and cannot be chosen
+//  by the registrar.
+//=================================================================================================
+
+const (
+	ATTR_ROLE     = "role"
+	ATTR_USERNAME = "hf.EnrollmentID"
+)
+
+var affiliations = map[string]string{
+	"VENDOR":       VENDOR,
+	"MANUFACTURER": VENDOR,
+	"WAREHOUSE":    WAREHOUSE,
+	"DISTRIBUTOR":  WAREHOUSE,
+	"STORE":        STORE,
+	"RETAILER":     STORE,
+	"CUSTOMER":     CUSTOMER,
+}
+
+//=================================================================================================
+//  get_attribute -- reads a certificate attribute of the submitter
+//=================================================================================================
+
+func (t *SimpleChainCode) get_attribute(stub shim.ChaincodeStubInterface, name string) (string, error) {
+
+	value, found, err := cid.GetAttributeValue(stub, name)
+
+	if err != nil { return "", errors.New("Couldn't get attribute '" + name + "'. Error: " + err.Error()) }
+
+	if !found { return "", errors.New("Couldn't get attribute '" + name + "'. Error: not in the certificate") }
+
+	return value, nil
+}
+
+//=================================================================================================
+//  get_username -- reads the enrolment id of the submitter from the transaction certificate. A
+//  certificate issued without attributes is identified by its subject and issuer instead.
+//=================================================================================================
+
+func (t *SimpleChainCode) get_username(stub shim.ChaincodeStubInterface) (string, error) {
+
+	username, found, err := cid.GetAttributeValue(stub, ATTR_USERNAME)
+
+	if err != nil { return "", errors.New("Couldn't get attribute '" + ATTR_USERNAME + "'. Error: " + err.Error()) }
+
+	if found && username != "" { return username, nil }
+
+	id, err := cid.GetID(stub)
+
+	if err != nil { return "", errors.New("Couldn't get the submitter's identity. Error: " + err.Error()) }
+
+	return id, nil
+}
+
+//=================================================================================================
+//  get_party -- the organisation of the submitter, by the id of its MSP. Roles say what a caller
+//  may do, the party which devices and consignments are its own.
+//=================================================================================================
+
+func (t *SimpleChainCode) get_party(stub shim.ChaincodeStubInterface) (string, error) {
+
+	mspid, err := cid.GetMSPID(stub)
+
+	if err != nil { return "", permission_denied("Couldn't get the submitter's MSP: %s", err) }
+
+	return mspid, nil
+}
+
+//=================================================================================================
+//  Parties. Any organisation's CA can put any role in a certificate, so a role is only accepted
+//  from an MSP registered for it. The MSPs of collections_config.json are known from the start;
+//  the vendor registers every other party with register_party, including the MSPs whose CAs
+//  enrol customers. A customer is known by its enrolment id alone, so every customer MSP must
+//  issue ids no other customer MSP issues.
+//=================================================================================================
+
+const PARTY_INDEX = "party~mspid"
+
+var default_parties = map[string]string{
+	"VendorMSP":    VENDOR,
+	"WarehouseMSP": WAREHOUSE,
+	"StoreMSP":     STORE,
+}
+
+type PartyRecord struct {
+	MSPID string `json:"mspid"`
+	Role  string `json:"role"`
+}
+
+func party_key(stub shim.ChaincodeStubInterface, mspid string) (string, error) {
+	return create_composite_key(stub, PARTY_INDEX, mspid)
+}
+
+//=================================================================================================
+//  get_party_role -- the role an MSP is registered for, "" if it has none
+//=================================================================================================
+
+func (t *SimpleChainCode) get_party_role(stub shim.ChaincodeStubInterface, mspid string) (string, error) {
+
+	key, err := party_key(stub, mspid)
+
+	if err != nil { return "", err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return "", errors.New("Unable to get party " + mspid) }
+
+	if bytes == nil { return default_parties[mspid], nil }
+
+	var p PartyRecord
+
+	err = json.Unmarshal(bytes, &p)
+
+	if err != nil { return "", errors.New("Corrupt party record " + mspid) }
+
+	return p.Role, nil
+}
+
+//=================================================================================================
+//  register_party -- records the role of an MSP, VENDOR, WAREHOUSE, STORE or CUSTOMER
+//=================================================================================================
+
+func (t *SimpleChainCode) register_party(stub shim.ChaincodeStubInterface, mspid string, role string) ([]byte, error) {
+
+	p := PartyRecord{MSPID: strings.TrimSpace(mspid), Role: strings.ToUpper(strings.TrimSpace(role))}
+
+	if p.MSPID == "" { return nil, validation_failed("A party needs an MSP id") }
+
+	if p.Role != VENDOR && p.Role != WAREHOUSE && p.Role != STORE && p.Role != CUSTOMER {
+		return nil, validation_failed("Unknown party role %s, expected VENDOR, WAREHOUSE, STORE or CUSTOMER", role)
+	}
+
+	bytes, err := json.Marshal(p)
+
+	if err != nil { return nil, errors.New("Error converting party record") }
+
+	key, err := party_key(stub, p.MSPID)
+
+	if err != nil { return nil, err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("REGISTER_PARTY: Error storing party %s: %s", p.MSPID, err); return nil, errors.New("Error storing party record") }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  check_affiliation -- maps the submitter's role attribute to VENDOR, WAREHOUSE, STORE or
+//  CUSTOMER and checks that the submitter's MSP is registered for that role
+//=================================================================================================
+
+func (t *SimpleChainCode) check_affiliation(stub shim.ChaincodeStubInterface) (string, error) {
+
+	role, err := t.get_attribute(stub, ATTR_ROLE)
+
+	if err != nil { return "", err }
+
+	affiliation, ok := affiliations[strings.ToUpper(strings.TrimSpace(role))]
+
+	if !ok { return "", permission_denied("Unrecognised caller role %s", role) }
+
+	party, err := t.get_party(stub)
+
+	if err != nil { return "", err }
+
+	registered, err := t.get_party_role(stub, party)
+
+	if err != nil { return "", err }
+
+	if registered != affiliation { return "", permission_denied("MSP %s is not registered for %s callers", party, affiliation) }
+
+	return affiliation, nil
+}
+
+//=================================================================================================
+//  get_caller_data -- returns the username and affiliation of the submitter
+//=================================================================================================
+
+func (t *SimpleChainCode) get_caller_data(stub shim.ChaincodeStubInterface) (string, string, error) {
+
+	user, err := t.get_username(stub)
+
+	if err != nil { return "", "", err }
+
+	affiliation, err := t.check_affiliation(stub)
+
+	if err != nil { return "", "", err }
+
+	return user, affiliation, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  IMEI_Info -- the parts of an IMEI (3GPP TS 23.003). TAC is the 8 digit Type Allocation Code
+//  that identifies the make and model, SNR the serial number. SVN is only present when the
+//  16 digit IMEISV form was supplied; IMEI is always the 15 digit form used as the ledger key.
+//=================================================================================================
+
+type IMEI_Info struct {
+	IMEI string `json:"imei"`
+	TAC  string `json:"tac"`
+	SNR  string `json:"snr"`
+	SVN  string `json:"svn,omitempty"`
+}
+
+//=================================================================================================
+//  luhn_check_digit -- computes the check digit for the 14 digit body of an IMEI
+//=================================================================================================
+
+func luhn_check_digit(body string) byte {
+
+	sum := 0
+
+	for i := 0; i < len(body); i++ {
+		digit := int(body[len(body)-1-i] - '0')
+		if i%2 == 0 {
+			digit *= 2
+			if digit > 9 { digit -= 9 }
+		}
+		sum += digit
+	}
+
+	return byte('0' + (10-sum%10)%10)
+}
+
+//=================================================================================================
+//  parse_imei -- validates a 15 digit IMEI (including its Luhn check digit) or a 16 digit IMEISV
+//=================================================================================================
+
+func parse_imei(value string) (IMEI_Info, error) {
+
+	var info IMEI_Info
+
+	value = strings.TrimSpace(value)
+
+	for _, c := range value {
+		if c < '0' || c > '9' { return info, validation_failed("Invalid IMEI %s: only digits are allowed", value) }
+	}
+
+	switch len(value) {
+	case 15:
+		if luhn_check_digit(value[:14]) != value[14] { return info, validation_failed("Invalid IMEI %s: check digit does not match", value) }
+		info.IMEI = value
+	case 16:
+		info.IMEI = value[:14] + string(luhn_check_digit(value[:14]))
+		info.SVN = value[14:]
+	default:
+		return info, validation_failed("Invalid IMEI %s: expected 15 digits or a 16 digit IMEISV", value)
+	}
+
+	info.TAC = info.IMEI[:8]
+	info.SNR = info.IMEI[8:14]
+
+	return info, nil
+}
+
+//=================================================================================================
+//  imei_of -- the IMEI a 16 digit IMEISV contains. Any other value is returned as given, to be
+//  validated or looked up where it is used.
+//=================================================================================================
+
+func imei_of(value string) string {
+
+	if len(strings.TrimSpace(value)) != 16 { return value }
+
+	info, err := parse_imei(value)
+
+	if err != nil { return value }
+
+	return info.IMEI
+}
+
+//=================================================================================================
+//  TAC_Record -- the make and model a Type Allocation Code was issued for
+//=================================================================================================
+
+type TAC_Record struct {
+	TAC         string `json:"tac"`
+	DeviceName  string `json:"devicename"`
+	DeviceModel string `json:"devicemodel"`
+}
+
+const TAC_INDEX = "tac~tac"
+
+func tac_key(stub shim.ChaincodeStubInterface, tac string) (string, error) {
+	return create_composite_key(stub, TAC_INDEX, tac)
+}
+
+//=================================================================================================
+//  register_tac -- records the make and model for a TAC, replacing any earlier registration
+//=================================================================================================
+
+func (t *SimpleChainCode) register_tac(stub shim.ChaincodeStubInterface, rec TAC_Record) ([]byte, error) {
+
+	if len(rec.TAC) != 8 || strings.Trim(rec.TAC, "0123456789") != "" { return nil, validation_failed("Invalid TAC %s: expected 8 digits", rec.TAC) }
+	if strings.TrimSpace(rec.DeviceName) == "" { return nil, validation_failed("Device name is required") }
+	if strings.TrimSpace(rec.DeviceModel) == "" { return nil, validation_failed("Device model is required") }
+
+	bytes, err := json.Marshal(rec)
+
+	if err != nil { return nil, errors.New("Error converting TAC record") }
+
+	key, err := tac_key(stub, rec.TAC)
+
+	if err != nil { return nil, err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("REGISTER_TAC: Error storing TAC record: %s", err); return nil, errors.New("Error storing TAC record") }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  get_tac_record -- returns the registration for a TAC and whether one exists
+//=================================================================================================
+
+func (t *SimpleChainCode) get_tac_record(stub shim.ChaincodeStubInterface, tac string) (TAC_Record, bool, error) {
+
+	var rec TAC_Record
+
+	key, err := tac_key(stub, tac)
+
+	if err != nil { return rec, false, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return rec, false, errors.New("Unable to get TAC " + tac) }
+
+	if bytes == nil { return rec, false, nil }
+
+	err = json.Unmarshal(bytes, &rec)
+
+	if err != nil { return rec, false, errors.New("Corrupt TAC record " + tac) }
+
+	return rec, true, nil
+}
+
+//=================================================================================================
+//  check_tac -- verifies that a device's declared name and model match the registration of its
+//  TAC. Devices whose TAC has not been registered yet are accepted.
+//=================================================================================================
+
+func (t *SimpleChainCode) check_tac(stub shim.ChaincodeStubInterface, tac string, name string, model string) error {
+
+	rec, found, err := t.get_tac_record(stub, tac)
+
+	if err != nil || !found { return err }
+
+	if !strings.EqualFold(rec.DeviceName, name) || !strings.EqualFold(rec.DeviceModel, model) {
+		return validation_failed("TAC %s is registered to %s %s, not %s %s", tac, rec.DeviceName, rec.DeviceModel, name, model)
+	}
+
+	return nil
+}
+
+//=================================================================================================
+//  decode_imei -- validates an IMEI and returns its parts with the registered make and model
+//=================================================================================================
+
+func (t *SimpleChainCode) decode_imei(stub shim.ChaincodeStubInterface, value string) ([]byte, error) {
+
+	info, err := parse_imei(value)
+
+	if err != nil { return nil, err }
+
+	rec, found, err := t.get_tac_record(stub, info.TAC)
+
+	if err != nil { return nil, err }
+
+	result := struct {
+		IMEI_Info
+		Registered *TAC_Record `json:"registered,omitempty"`
+	}{IMEI_Info: info}
+
+	if found { result.Registered = &rec }
+
+	return json.Marshal(result)
+}
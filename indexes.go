@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  Secondary indexes. Each entry is a composite key <index>, <value>, <imei> with an empty value,
+//  kept up to date by save_changes, so devices can be listed by owner, status, consignment or
+//  model without reading every device.
+//=================================================================================================
+
+const (
+	OWNER_INDEX       = "owner~imei"
+	STATUS_INDEX      = "status~imei"
+	CONSIGNMENT_INDEX = "consignment~imei"
+	MODEL_INDEX       = "model~imei"
+)
+
+var device_indexes = []struct {
+	Name  string
+	Value func(d Device) string
+}{
+	{OWNER_INDEX, func(d Device) string { return d.Owner }},
+	{STATUS_INDEX, func(d Device) string { return d.Status }},
+	{CONSIGNMENT_INDEX, func(d Device) string { return d.ConsignmentNumber }},
+	{MODEL_INDEX, func(d Device) string { return d.DeviceModel }},
+}
+
+var index_marker = []byte{0x00}
+
+//=================================================================================================
+//  update_indexes -- moves the index entries of a device from its previous values (nil for a new
+//  device) to its current ones. Empty values are not indexed.
+//=================================================================================================
+
+func (t *SimpleChainCode) update_indexes(stub shim.ChaincodeStubInterface, previous *Device, d Device) error {
+
+	for _, index := range device_indexes {
+
+		value := index.Value(d)
+
+		if previous != nil {
+			old := index.Value(*previous)
+
+			if old == value { continue }
+
+			if old != "" {
+				key, err := create_composite_key(stub, index.Name, old, previous.IMEI)
+				if err != nil { return err }
+				err = stub.DelState(key)
+				if err != nil { fmt.Printf("UPDATE_INDEXES: Error removing %s entry: %s", index.Name, err); return errors.New("Error updating index " + index.Name) }
+			}
+		}
+
+		if value == "" { continue }
+
+		key, err := create_composite_key(stub, index.Name, value, d.IMEI)
+
+		if err != nil { return err }
+
+		err = stub.PutState(key, index_marker)
+
+		if err != nil { fmt.Printf("UPDATE_INDEXES: Error storing %s entry: %s", index.Name, err); return errors.New("Error updating index " + index.Name) }
+	}
+
+	return nil
+}
+
+//=================================================================================================
+//  get_devices_by_index -- returns the devices the reader may read whose index entry has the given
+//  value
+//=================================================================================================
+
+func (t *SimpleChainCode) get_devices_by_index(stub shim.ChaincodeStubInterface, r Reader, index string, value string) ([]byte, error) {
+
+	devices := []Device{}
+
+	err := t.for_each_partial_key(stub, index, []string{value}, func(key string, _ []byte) (bool, error) {
+
+		attributes, err := split_composite_key(stub, key)
+
+		if err != nil || len(attributes) != 2 { return false, errors.New("Corrupt " + index + " entry") }
+
+		dev, err := t.get_device(stub, attributes[1])
+
+		if err != nil { return false, err }
+
+		if r.view(dev) == VIEW_FULL { devices = append(devices, dev) }
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(devices)
+
+	if err != nil { return nil, errors.New("Error converting devices") }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  rebuild_indexes -- writes the index entries of every device; used once for devices stored
+//  before the indexes existed
+//=================================================================================================
+
+func (t *SimpleChainCode) rebuild_indexes(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	count := 0
+
+	err := t.for_each_partial_key(stub, DEVICE_INDEX, nil, func(key string, value []byte) (bool, error) {
+
+		var dev Device
+
+		err := json.Unmarshal(value, &dev)
+
+		if err != nil { return false, errors.New("Unable to read device " + key) }
+
+		err = t.update_indexes(stub, nil, dev)
+
+		if err != nil { return false, err }
+
+		count++
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	return []byte(fmt.Sprintf("%d", count)), nil
+}
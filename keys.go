@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  Composite keys are built and split by the stub. Keys written before the move to the contract
+//  API used the same layout, so they are found by GetStateByPartialCompositeKey.
+//=================================================================================================
+
+const DEVICE_INDEX = "device~imei"
+
+func create_composite_key(stub shim.ChaincodeStubInterface, objectType string, attributes ...string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+
+	if err != nil { fmt.Printf("CREATE_COMPOSITE_KEY: %s %v: %s", objectType, attributes, err); return "", validation_failed("Invalid %s key %v", objectType, attributes) }
+
+	return key, nil
+}
+
+func split_composite_key(stub shim.ChaincodeStubInterface, key string) ([]string, error) {
+
+	_, attributes, err := stub.SplitCompositeKey(key)
+
+	if err != nil { return nil, errors.New("Corrupt composite key") }
+
+	return attributes, nil
+}
+
+func device_key(stub shim.ChaincodeStubInterface, imei string) (string, error) {
+	return create_composite_key(stub, DEVICE_INDEX, imei)
+}
+
+//=================================================================================================
+//  for_each_partial_key -- calls fn for every key starting with the given object type and leading
+//  attributes, in key order, until fn returns false or an error
+//=================================================================================================
+
+func (t *SimpleChainCode) for_each_partial_key(stub shim.ChaincodeStubInterface, objectType string, attributes []string, fn func(key string, value []byte) (bool, error)) error {
+
+	iter, err := stub.GetStateByPartialCompositeKey(objectType, attributes)
+
+	if err != nil { fmt.Printf("FOR_EACH_PARTIAL_KEY: range query failed: %s", err); return errors.New("Unable to list " + objectType) }
+
+	defer iter.Close()
+
+	for iter.HasNext() {
+		kv, err := iter.Next()
+
+		if err != nil { return errors.New("Unable to list " + objectType) }
+
+		more, err := fn(kv.Key, kv.Value)
+
+		if err != nil { return err }
+
+		if !more { break }
+	}
+
+	return nil
+}
+
+//=================================================================================================
+//  migrate_imei_index -- one-time conversion from the IMEI_Holder record, where every device was
+//  stored under its bare IMEI, to devices keyed under device~imei. A device that was saved under
+//  the composite key before the migration ran keeps that newer record.
+//=================================================================================================
+
+func (t *SimpleChainCode) migrate_imei_index(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	var imeiIDs IMEI_Holder
+
+	bytes, err := stub.GetState("imeiIds")
+
+	if err != nil { return nil, errors.New("Unable to get imeiIds") }
+
+	if bytes == nil { return []byte("0"), nil }
+
+	err = json.Unmarshal(bytes, &imeiIDs)
+
+	if err != nil { return nil, errors.New("Corrupt IMEI_Holder record") }
+
+	for _, imei := range imeiIDs.IMEIs {
+
+		legacy, err := stub.GetState(imei)
+
+		if err != nil { return nil, errors.New("Unable to get device " + imei) }
+
+		if legacy == nil { continue }
+
+		key, err := device_key(stub, imei)
+
+		if err != nil { return nil, err }
+
+		current, err := stub.GetState(key)
+
+		if err != nil { return nil, errors.New("Unable to get device " + imei) }
+
+		if current == nil {
+			err = stub.PutState(key, legacy)
+			if err != nil { fmt.Printf("MIGRATE_IMEI_INDEX: Error storing device %s: %s", imei, err); return nil, errors.New("Error storing device " + imei) }
+		}
+
+		err = stub.DelState(imei)
+
+		if err != nil { return nil, errors.New("Unable to remove legacy record for " + imei) }
+	}
+
+	err = stub.DelState("imeiIds")
+
+	if err != nil { return nil, errors.New("Unable to remove imeiIds") }
+
+	return []byte(fmt.Sprintf("%d", len(imeiIDs.IMEIs))), nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+//=================================================================================================
+//  test_ledger -- an in-memory ledger for driving the chaincode in tests. Every call runs in its own
+//  transaction as the caller selected with as(), with the transient data set before it; the events
+//  each transaction set are kept in events.
+//=================================================================================================
+
+type test_event struct {
+	Name    string
+	Payload []byte
+}
+
+type test_ledger struct {
+	t      *testing.T
+	stub   *test_stub
+	cc     *SimpleChainCode
+	tx     int
+	events []test_event
+}
+
+func new_test_ledger(t *testing.T) *test_ledger {
+
+	l := &test_ledger{t: t, stub: &test_stub{MockStub: shimtest.NewMockStub("devices", nil)}, cc: new(SimpleChainCode)}
+
+	l.begin()
+	_, err := l.cc.init_ledger(l.stub)
+	if err == nil { err = seed_vendor(l.stub) }
+	l.end()
+
+	if err != nil { t.Fatalf("init_ledger: %s", err) }
+
+	// the MSP of every party is named after its role, other parties of a role add a number
+	for _, p := range []struct{ MSPID, Role string }{{"VENDOR2", VENDOR}, {WAREHOUSE, WAREHOUSE}, {"WH2", WAREHOUSE}, {STORE, STORE}, {"STORE2", STORE}, {CUSTOMER, CUSTOMER}} {
+		l.as(VENDOR).must("register_party", p.MSPID, p.Role)
+	}
+
+	l.stub.TransientMap = map[string][]byte{TRANSIENT_CUSTOMER_SECRET: test_secret}
+	l.as(VENDOR).must("set_customer_secret")
+
+	return l
+}
+
+var test_secret = []byte("0123456789abcdef0123456789abcdef")
+
+// seed_vendor registers the MSP VENDOR the test vendor signs with, as VendorMSP is on a network
+func seed_vendor(stub shim.ChaincodeStubInterface) error {
+	key, err := party_key(stub, VENDOR)
+	if err != nil { return err }
+	return stub.PutState(key, []byte(`{"mspid":"VENDOR","role":"VENDOR"}`))
+}
+
+//=================================================================================================
+//  test_stub -- the MockStub with the paginated query it leaves unimplemented. As on a peer, the
+//  bookmark is the key the page starts at and is empty after the last page, and the writes of a
+//  transaction are held back until it ends, so that it does not read them itself.
+//=================================================================================================
+
+type test_stub struct {
+	*shimtest.MockStub
+	writes map[string][]byte
+}
+
+// a nil value in writes deletes the key
+func (s *test_stub) PutState(key string, value []byte) error {
+	if value == nil { value = []byte{} }
+	if s.writes == nil { s.writes = map[string][]byte{} }
+	s.writes[key] = value
+	return nil
+}
+
+func (s *test_stub) DelState(key string) error {
+	if s.writes == nil { s.writes = map[string][]byte{} }
+	s.writes[key] = nil
+	return nil
+}
+
+// commit applies the writes of the transaction to the ledger
+func (s *test_stub) commit() {
+	for key, value := range s.writes {
+		if value == nil {
+			s.MockStub.DelState(key)
+		} else {
+			s.MockStub.PutState(key, value)
+		}
+	}
+	s.writes = nil
+}
+
+type test_iterator struct {
+	kvs []*queryresult.KV
+}
+
+func (i *test_iterator) HasNext() bool { return len(i.kvs) > 0 }
+func (i *test_iterator) Close() error  { return nil }
+
+func (i *test_iterator) Next() (*queryresult.KV, error) {
+	kv := i.kvs[0]
+	i.kvs = i.kvs[1:]
+	return kv, nil
+}
+
+func (s *test_stub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+
+	iter, err := s.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil { return nil, nil, err }
+	defer iter.Close()
+
+	page, meta := &test_iterator{}, &peer.QueryResponseMetadata{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil { return nil, nil, err }
+		if kv.Key < bookmark { continue }
+		if len(page.kvs) == int(pageSize) { meta.Bookmark = kv.Key; break }
+		page.kvs = append(page.kvs, kv)
+	}
+	meta.FetchedRecordsCount = int32(len(page.kvs))
+	return page, meta, nil
+}
+
+// identities caches one certificate per role, generating keys is slow
+var identities = map[string][]byte{}
+
+// test_identity builds a serialized identity of the MSP mspid whose certificate carries the role
+// and username attributes the way the Fabric CA encodes them
+func test_identity(t *testing.T, role string, username string, mspid string) []byte {
+
+	if id, ok := identities[role+"/"+username+"@"+mspid]; ok { return id }
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil { t.Fatal(err) }
+
+	attrs, err := json.Marshal(map[string]map[string]string{"attrs": {ATTR_ROLE: role, ATTR_USERNAME: username}})
+	if err != nil { t.Fatal(err) }
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: username},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attrs}},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil { t.Fatal(err) }
+
+	id, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspid, IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	if err != nil { t.Fatal(err) }
+
+	identities[role+"/"+username+"@"+mspid] = id
+	return id
+}
+
+// as makes the caller the party of the role that is named after it, e.g. the STORE of MSP STORE
+func (l *test_ledger) as(role string) *test_ledger {
+	return l.as_party(role, role)
+}
+
+// as_party makes the caller a member of another party of the role
+func (l *test_ledger) as_party(role string, party string) *test_ledger {
+	username := strings.ToLower(role)
+	if party != role { username += "@" + strings.ToLower(party) }
+	l.stub.Creator = test_identity(l.t, role, username, party)
+	return l
+}
+
+// as_user makes the caller a user of the role with the given enrolment id in a party
+func (l *test_ledger) as_user(role string, username string, party string) *test_ledger {
+	l.stub.Creator = test_identity(l.t, role, username, party)
+	return l
+}
+
+func (l *test_ledger) begin() {
+	l.tx++
+	l.stub.MockTransactionStart(fmt.Sprintf("tx%d", l.tx))
+}
+
+func (l *test_ledger) end() {
+	l.stub.commit()
+	l.stub.MockTransactionEnd(fmt.Sprintf("tx%d", l.tx))
+	for len(l.stub.ChaincodeEventsChannel) > 0 {
+		e := <-l.stub.ChaincodeEventsChannel
+		l.events = append(l.events, test_event{Name: e.EventName, Payload: e.Payload})
+	}
+}
+
+// for_customer passes the customer id in the transient map of the next call
+func (l *test_ledger) for_customer(customer string) *test_ledger {
+	l.stub.TransientMap = map[string][]byte{TRANSIENT_CUSTOMER: []byte(customer)}
+	return l
+}
+
+// selling passes SaleDetails with the seller and the customer id in the transient map of the next
+// call
+func (l *test_ledger) selling(seller string, customer string) *test_ledger {
+	bytes, err := json.Marshal(SaleDetails{Customer: customer, Seller: seller})
+	if err != nil { l.t.Fatal(err) }
+	l.stub.TransientMap = map[string][]byte{TRANSIENT_SALE: bytes}
+	return l
+}
+
+// call runs a function by its legacy name in a transaction of its own
+func (l *test_ledger) call(function string, args ...string) (string, error) {
+	l.begin()
+	defer l.end()
+	defer func() { l.stub.TransientMap = nil }()
+	bytes, err := l.cc.call(l.stub, function, args)
+	return string(bytes), err
+}
+
+// must runs a function that is expected to succeed
+func (l *test_ledger) must(function string, args ...string) string {
+	l.t.Helper()
+	out, err := l.call(function, args...)
+	if err != nil { l.t.Fatalf("%s %v: %s", function, args, err) }
+	return out
+}
+
+// fails runs a function that is expected to fail with the given error code
+func (l *test_ledger) fails(code string, function string, args ...string) *ChaincodeError {
+	l.t.Helper()
+	_, err := l.call(function, args...)
+	if err == nil { l.t.Fatalf("%s %v succeeded, expected %s", function, args, code) }
+	ce := error_of(l.t, err)
+	if ce.Code != code { l.t.Fatalf("%s %v: expected %s, got %s", function, args, code, err) }
+	return ce
+}
+
+// device reads a device as the vendor, whose read policy covers every device, and leaves the
+// caller as it was
+func (l *test_ledger) device(imei string) Device {
+	l.t.Helper()
+	defer func(creator []byte) { l.stub.Creator = creator }(l.stub.Creator)
+	l.as(VENDOR)
+	var d Device
+	if err := json.Unmarshal([]byte(l.must("get_device_details", imei)), &d); err != nil { l.t.Fatal(err) }
+	return d
+}
+
+// create registers a device as the vendor and returns its IMEI
+func (l *test_ledger) create(serial int) string {
+	l.t.Helper()
+	imei := test_imei(serial)
+	l.as(VENDOR).must("create_device", imei, "LENOVO", "VIBE", "2016-12-03")
+	return imei
+}
+
+func error_of(t *testing.T, err error) *ChaincodeError {
+	t.Helper()
+	var ce ChaincodeError
+	if json.Unmarshal([]byte(err.Error()), &ce) != nil { t.Fatalf("error is not a ChaincodeError: %s", err) }
+	return &ce
+}
+
+// test_imei returns a valid IMEI with the given serial number
+func test_imei(serial int) string {
+	body := fmt.Sprintf("35209900%06d", serial)
+	return body + string(luhn_check_digit(body))
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  Affiliations and device statuses used by the lifecycle table
+//=================================================================================================
+
+const (
+	VENDOR    = "VENDOR"
+	WAREHOUSE = "WAREHOUSE"
+	STORE     = "STORE"
+	CUSTOMER  = "CUSTOMER"
+)
+
+const (
+	STATUS_CREATED                = "CREATED"
+	STATUS_DELIVERED_TO_WAREHOUSE = "DELIVERED_TO_WAREHOUSE"
+	STATUS_DELIVERED_TO_STORE     = "DELIVERED_TO_STORE"
+	STATUS_DELIVERED_TO_CUSTOMER  = "DELIVERED_TO_CUSTOMER"
+	STATUS_RECEIVED               = "Received"
+	STATUS_RETURNED_TO_STORE      = "RETURNED_TO_STORE"
+	STATUS_RETURNED_TO_WAREHOUSE  = "RETURNED_TO_WAREHOUSE"
+	STATUS_RETURNED_TO_VENDOR     = "RETURNED_TO_VENDOR"
+	STATUS_EXCHANGED              = "Exchanged"
+	STATUS_REPLACED               = "REPLACED"
+	STATUS_IN_TRANSIT_MISSING     = "IN_TRANSIT_MISSING"
+	STATUS_IN_REPAIR              = "IN_REPAIR"
+	STATUS_REFURBISHED            = "REFURBISHED"
+	STATUS_SCRAPPED               = "SCRAPPED"
+)
+
+// A transition with a Condition only applies to devices in that condition
+const (
+	CONDITION_NEW         = "NEW"
+	CONDITION_REFURBISHED = "REFURBISHED"
+)
+
+// Values in Transition.Sets are either literals or one of these sources. SET_CUSTOMER stores the
+// customer_hash of the named argument instead of the argument itself, SET_WARRANTY the end of the
+// warranty of a device sold now, from its model's WarrantyPolicy, SET_TXID the transaction id,
+// SET_PARTY the party of the caller and SET_OWNERID the OwnerID of the device before the transition.
+const (
+	SET_NOW      = "$now"
+	SET_ARG      = "$arg:"
+	SET_CUSTOMER = "$customer:"
+	SET_WARRANTY = "$warranty"
+	SET_TXID     = "$txid"
+	SET_PARTY    = "$party"
+	SET_OWNERID  = "$ownerid"
+)
+
+//=================================================================================================
+//  Transition -- one edge of the device lifecycle. A device may take the edge when its status is
+//  From and, if Owner is set, its owner is Owner. Sets maps Device json fields to the value they
+//  receive; Counterpart describes a second device the transition depends on and the status it
+//  moves to (EXCHANGE_DEV).
+//  Transitions that ship a device name the function the recipient accepts it with in AcceptedBy,
+//  and address it to the party named by the recipient argument; only that party can accept it.
+//  A caller of the owner's role can only move a device its own party holds.
+//  Private names the inputs passed in the transient map rather than as arguments, so that they are
+//  not written to the transaction; Customer names the input that must identify the customer the
+//  device belongs to.
+//  Condition restricts the edge to new or to refurbished devices. An Internal edge is only taken
+//  by the chaincode itself, as part of another function, and cannot be invoked.
+//=================================================================================================
+
+type Transition struct {
+	Function    string            `json:"function"`
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Caller      string            `json:"caller"`
+	Owner       string            `json:"owner,omitempty"`
+	Recipient   string            `json:"recipient"`
+	Args        []string          `json:"args"`
+	Sets        map[string]string `json:"sets"`
+	Counterpart *Counterpart      `json:"counterpart,omitempty"`
+	AcceptedBy  string            `json:"acceptedby,omitempty"`
+	Private     []string          `json:"private,omitempty"`
+	Customer    string            `json:"customer,omitempty"`
+	Condition   string            `json:"condition,omitempty"`
+	Internal    bool              `json:"internal,omitempty"`
+}
+
+type Counterpart struct {
+	Arg   string `json:"arg"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Owner string `json:"owner,omitempty"`
+}
+
+var lifecycle = []Transition{
+	{Function: "TRF_TO_WH", From: STATUS_CREATED, To: STATUS_DELIVERED_TO_WAREHOUSE,
+		Caller: VENDOR, Owner: VENDOR, Recipient: WAREHOUSE,
+		Args: []string{"imei", "recipient", "consignment"},
+		Sets: map[string]string{"dateofdelivery": SET_NOW, "consignmentnumber": SET_ARG + "consignment", "shippedto": SET_ARG + "recipient"},
+		AcceptedBy: "ACPT_FROM_VENDOR"},
+
+	{Function: "ACPT_FROM_VENDOR", From: STATUS_DELIVERED_TO_WAREHOUSE, To: STATUS_RECEIVED,
+		Caller: WAREHOUSE, Owner: VENDOR, Recipient: WAREHOUSE,
+		Args: []string{"imei", "recipient"},
+		Sets: map[string]string{"owner": WAREHOUSE, "ownerid": SET_PARTY, "shippedto": "", "dateofreceipt": SET_NOW}},
+
+	{Function: "TRF_TO_STRE", From: STATUS_RECEIVED, To: STATUS_DELIVERED_TO_STORE,
+		Caller: WAREHOUSE, Owner: WAREHOUSE, Recipient: STORE,
+		Args: []string{"imei", "recipient", "consignment"},
+		Sets: map[string]string{"dateofdelivery": SET_NOW, "consignmentnumber": SET_ARG + "consignment", "shippedto": SET_ARG + "recipient"},
+		AcceptedBy: "ACPT_FROM_WAREHOUSE"},
+
+	{Function: "ACPT_FROM_WAREHOUSE", From: STATUS_DELIVERED_TO_STORE, To: STATUS_RECEIVED,
+		Caller: STORE, Owner: WAREHOUSE, Recipient: STORE,
+		Args: []string{"imei", "recipient"},
+		Sets: map[string]string{"owner": STORE, "ownerid": SET_PARTY, "shippedto": "", "dateofreceipt": SET_NOW}},
+
+	{Function: "TRF_TO_CUST", From: STATUS_RECEIVED, To: STATUS_DELIVERED_TO_CUSTOMER,
+		Caller: STORE, Owner: STORE, Recipient: STORE, Condition: CONDITION_NEW,
+		Args: []string{"imei"}, Private: []string{"customer"},
+		Sets: map[string]string{"dateofsale": SET_NOW, "owner": CUSTOMER, "ownerid": SET_CUSTOMER + "customer", "sellingstore": SET_PARTY,
+			"warrantyexpires": SET_WARRANTY}},
+
+	// a refurbished device can only be sold as such
+	{Function: "TRF_TO_CUST_REFURB", From: STATUS_RECEIVED, To: STATUS_DELIVERED_TO_CUSTOMER,
+		Caller: STORE, Owner: STORE, Recipient: STORE, Condition: CONDITION_REFURBISHED,
+		Args: []string{"imei"}, Private: []string{"customer"},
+		Sets: map[string]string{"dateofsale": SET_NOW, "owner": CUSTOMER, "ownerid": SET_CUSTOMER + "customer", "sellingstore": SET_PARTY,
+			"warrantyexpires": SET_WARRANTY}},
+
+	{Function: "RTN_FROM_CUST", From: STATUS_DELIVERED_TO_CUSTOMER, To: STATUS_RETURNED_TO_STORE,
+		Caller: STORE, Owner: CUSTOMER, Recipient: STORE,
+		Args: []string{"imei", "recipient"}, Private: []string{"customer"}, Customer: "customer",
+		Sets: map[string]string{"dateofreceipt": SET_NOW, "owner": STORE, "ownerid": SET_PARTY, "returnedby": SET_OWNERID}},
+
+	{Function: "RTN_FROM_CUST", From: STATUS_EXCHANGED, To: STATUS_RETURNED_TO_STORE,
+		Caller: STORE, Owner: CUSTOMER, Recipient: STORE,
+		Args: []string{"imei", "recipient"}, Private: []string{"customer"}, Customer: "customer",
+		Sets: map[string]string{"dateofreceipt": SET_NOW, "owner": STORE, "ownerid": SET_PARTY, "returnedby": SET_OWNERID}},
+
+	{Function: "EXCHANGE_DEV", From: STATUS_RECEIVED, To: STATUS_EXCHANGED,
+		Caller: STORE, Owner: STORE, Recipient: CUSTOMER,
+		Args: []string{"imei", "oldimei"}, Private: []string{"customer"},
+		Sets: map[string]string{"dateofsale": SET_NOW, "owner": CUSTOMER, "ownerid": SET_CUSTOMER + "customer", "sellingstore": SET_PARTY,
+			"warrantyexpires": SET_WARRANTY, "oldimei": SET_ARG + "oldimei", "replaces": SET_ARG + "oldimei"},
+		Counterpart: &Counterpart{Arg: "oldimei", From: STATUS_RETURNED_TO_STORE, To: STATUS_REPLACED, Owner: STORE}},
+
+	{Function: "RTN_TO_WAREHOUSE", From: STATUS_RETURNED_TO_STORE, To: STATUS_RETURNED_TO_WAREHOUSE,
+		Caller: STORE, Owner: STORE, Recipient: WAREHOUSE,
+		Args: []string{"imei", "recipient", "consignment"},
+		Sets: map[string]string{"dateofdelivery": SET_NOW, "consignmentnumber": SET_ARG + "consignment", "shippedto": SET_ARG + "recipient"},
+		AcceptedBy: "ACPT_FROM_STRE"},
+
+	// a device taken back in an exchange goes back to the warehouse like any other return
+	{Function: "RTN_TO_WAREHOUSE", From: STATUS_REPLACED, To: STATUS_RETURNED_TO_WAREHOUSE,
+		Caller: STORE, Owner: STORE, Recipient: WAREHOUSE,
+		Args: []string{"imei", "recipient", "consignment"},
+		Sets: map[string]string{"dateofdelivery": SET_NOW, "consignmentnumber": SET_ARG + "consignment", "shippedto": SET_ARG + "recipient"},
+		AcceptedBy: "ACPT_FROM_STRE"},
+
+	{Function: "ACPT_FROM_STRE", From: STATUS_RETURNED_TO_WAREHOUSE, To: STATUS_RECEIVED,
+		Caller: WAREHOUSE, Owner: STORE, Recipient: WAREHOUSE,
+		Args: []string{"imei", "recipient"},
+		Sets: map[string]string{"owner": WAREHOUSE, "ownerid": SET_PARTY, "shippedto": "", "dateofreceipt": SET_NOW}},
+
+	{Function: "RTN_TO_VENDOR", From: STATUS_RECEIVED, To: STATUS_RETURNED_TO_VENDOR,
+		Caller: WAREHOUSE, Owner: WAREHOUSE, Recipient: VENDOR,
+		Args: []string{"imei", "recipient", "consignment"},
+		Sets: map[string]string{"dateofdelivery": SET_NOW, "consignmentnumber": SET_ARG + "consignment", "shippedto": SET_ARG + "recipient"},
+		AcceptedBy: "ACPT_RTN_FROM_WAREHOUSE"},
+
+	{Function: "ACPT_RTN_FROM_WAREHOUSE", From: STATUS_RETURNED_TO_VENDOR, To: STATUS_RECEIVED,
+		Caller: VENDOR, Owner: WAREHOUSE, Recipient: VENDOR,
+		Args: []string{"imei", "recipient"},
+		Sets: map[string]string{"owner": VENDOR, "ownerid": SET_PARTY, "shippedto": "", "dateofreceipt": SET_NOW}},
+
+	// a device returned to the vendor is repaired and graded, or scrapped; a refurbished device
+	// goes back to the warehouse flagged as refurbished
+	{Function: "START_REPAIR", From: STATUS_RECEIVED, To: STATUS_IN_REPAIR,
+		Caller: VENDOR, Owner: VENDOR, Recipient: VENDOR,
+		Args: []string{"imei", "technician", "fault"},
+		Sets: map[string]string{"repair": SET_TXID}},
+
+	{Function: "REFURBISH_DEV", From: STATUS_IN_REPAIR, To: STATUS_REFURBISHED,
+		Caller: VENDOR, Owner: VENDOR, Recipient: VENDOR,
+		Args: []string{"imei", "grade", "parts"},
+		Sets: map[string]string{"repair": "", "refurbished": "true", "grade": SET_ARG + "grade"}},
+
+	{Function: "SCRAP_DEV", From: STATUS_IN_REPAIR, To: STATUS_SCRAPPED,
+		Caller: VENDOR, Owner: VENDOR, Recipient: VENDOR,
+		Args: []string{"imei", "reason"},
+		Sets: map[string]string{"repair": ""}},
+
+	{Function: "TRF_TO_WH", From: STATUS_REFURBISHED, To: STATUS_DELIVERED_TO_WAREHOUSE,
+		Caller: VENDOR, Owner: VENDOR, Recipient: WAREHOUSE,
+		Args: []string{"imei", "recipient", "consignment"},
+		Sets: map[string]string{"dateofdelivery": SET_NOW, "consignmentnumber": SET_ARG + "consignment", "shippedto": SET_ARG + "recipient"},
+		AcceptedBy: "ACPT_FROM_VENDOR"},
+
+	// a shipped device that was not in the consignment when it arrived, marked by ACPT_CONSIGNMENT,
+	// and its late arrival
+	{Function: "MARK_MISSING", From: STATUS_DELIVERED_TO_WAREHOUSE, To: STATUS_IN_TRANSIT_MISSING,
+		Caller: WAREHOUSE, Owner: VENDOR, Recipient: WAREHOUSE,
+		Args: []string{"imei"}, Sets: map[string]string{}, Internal: true},
+
+	{Function: "MARK_MISSING", From: STATUS_DELIVERED_TO_STORE, To: STATUS_IN_TRANSIT_MISSING,
+		Caller: STORE, Owner: WAREHOUSE, Recipient: STORE,
+		Args: []string{"imei"}, Sets: map[string]string{}, Internal: true},
+
+	{Function: "MARK_MISSING", From: STATUS_RETURNED_TO_WAREHOUSE, To: STATUS_IN_TRANSIT_MISSING,
+		Caller: WAREHOUSE, Owner: STORE, Recipient: WAREHOUSE,
+		Args: []string{"imei"}, Sets: map[string]string{}, Internal: true},
+
+	{Function: "MARK_MISSING", From: STATUS_RETURNED_TO_VENDOR, To: STATUS_IN_TRANSIT_MISSING,
+		Caller: VENDOR, Owner: WAREHOUSE, Recipient: VENDOR,
+		Args: []string{"imei"}, Sets: map[string]string{}, Internal: true},
+
+	{Function: "ACPT_FROM_VENDOR", From: STATUS_IN_TRANSIT_MISSING, To: STATUS_RECEIVED,
+		Caller: WAREHOUSE, Owner: VENDOR, Recipient: WAREHOUSE,
+		Args: []string{"imei", "recipient"},
+		Sets: map[string]string{"owner": WAREHOUSE, "ownerid": SET_PARTY, "shippedto": "", "dateofreceipt": SET_NOW}},
+
+	{Function: "ACPT_FROM_WAREHOUSE", From: STATUS_IN_TRANSIT_MISSING, To: STATUS_RECEIVED,
+		Caller: STORE, Owner: WAREHOUSE, Recipient: STORE,
+		Args: []string{"imei", "recipient"},
+		Sets: map[string]string{"owner": STORE, "ownerid": SET_PARTY, "shippedto": "", "dateofreceipt": SET_NOW}},
+
+	{Function: "ACPT_FROM_STRE", From: STATUS_IN_TRANSIT_MISSING, To: STATUS_RECEIVED,
+		Caller: WAREHOUSE, Owner: STORE, Recipient: WAREHOUSE,
+		Args: []string{"imei", "recipient"},
+		Sets: map[string]string{"owner": WAREHOUSE, "ownerid": SET_PARTY, "shippedto": "", "dateofreceipt": SET_NOW}},
+
+	{Function: "ACPT_RTN_FROM_WAREHOUSE", From: STATUS_IN_TRANSIT_MISSING, To: STATUS_RECEIVED,
+		Caller: VENDOR, Owner: WAREHOUSE, Recipient: VENDOR,
+		Args: []string{"imei", "recipient"},
+		Sets: map[string]string{"owner": VENDOR, "ownerid": SET_PARTY, "shippedto": "", "dateofreceipt": SET_NOW}},
+}
+
+//=================================================================================================
+//  lifecycle_transitions -- returns every table entry for a function, nil if it is not a transition
+//=================================================================================================
+
+func lifecycle_transitions(function string) []Transition {
+	var found []Transition
+	for _, tr := range lifecycle {
+		if tr.Function == function { found = append(found, tr) }
+	}
+	return found
+}
+
+//=================================================================================================
+//  find_transition -- picks the entry for function that applies to the device's current state
+//=================================================================================================
+
+func find_transition(function string, dev Device) (Transition, error) {
+	candidates := lifecycle_transitions(function)
+	if len(candidates) == 0 { return Transition{}, validation_failed("Unknown lifecycle function %s", function) }
+
+	expected := []DeviceState{}
+	condition := ""
+	for _, tr := range candidates {
+		if tr.From == dev.Status && (tr.Owner == "" || tr.Owner == dev.Owner) {
+			if tr.Condition == "" || tr.Condition == dev.condition() { return tr, nil }
+			condition = tr.Condition
+		}
+		expected = append(expected, DeviceState{Status: tr.From, Owner: tr.Owner})
+	}
+
+	e := invalid_transition(function, dev, expected)
+	if condition != "" {
+		e.Message = fmt.Sprintf("%s is for %s devices, device %s is %s", function, strings.ToLower(condition), dev.IMEI, strings.ToLower(dev.condition()))
+	}
+	return Transition{}, e
+}
+
+//=================================================================================================
+//  run_transition -- moves the device named by args[0] along the edge selected for function and
+//  returns the change for the transaction's lifecycle event
+//=================================================================================================
+
+func (t *SimpleChainCode) run_transition(stub shim.ChaincodeStubInterface, callerAffiliation string, function string, args []string) (DeviceChange, error) {
+	return t.run_transition_setting(stub, callerAffiliation, function, args, nil)
+}
+
+//=================================================================================================
+//  run_transition_setting -- run_transition that also assigns the Device json fields in extra,
+//  after the edge's Sets. A transaction does not read its own writes, so whatever a caller adds
+//  to the device has to be saved with the transition.
+//=================================================================================================
+
+func (t *SimpleChainCode) run_transition_setting(stub shim.ChaincodeStubInterface, callerAffiliation string, function string, args []string, extra map[string]string) (DeviceChange, error) {
+
+	var change DeviceChange
+
+	candidates := lifecycle_transitions(function)
+	if len(candidates) == 0 { return change, validation_failed("Unknown lifecycle function %s", function) }
+	if len(args) < len(candidates[0].Args) {
+		return change, validation_failed("%s expects arguments %s", function, strings.Join(candidates[0].Args, ", "))
+	}
+
+	dev, err := t.get_device(stub, args[0])
+	if err != nil { fmt.Printf("RUN_TRANSITION: error retrieving device %s", args[0]); return change, err }
+
+	tr, err := find_transition(function, dev)
+	if err != nil { fmt.Printf("RUN_TRANSITION: %s", err); return change, err }
+
+	if callerAffiliation != tr.Caller {
+		fmt.Printf("RUN_TRANSITION: %s :: Permission denied for %s", function, callerAffiliation)
+		return change, permission_denied("%s requires %s", function, tr.Caller)
+	}
+
+	if dev.Blacklisted != "" { fmt.Printf("RUN_TRANSITION: %s :: device %s is blacklisted", function, dev.IMEI); return change, blacklisted(dev) }
+
+	party, err := t.get_party(stub)
+	if err != nil { return change, err }
+
+	// for devices recorded before parties existed only the role is checked
+	if tr.Caller == tr.Owner && dev.OwnerID != "" && dev.OwnerID != party {
+		return change, permission_denied("Device %s is held by %s, not by %s", dev.IMEI, dev.OwnerID, party)
+	}
+	if tr.Caller != tr.Owner && dev.ShippedTo != "" && dev.ShippedTo != party {
+		return change, permission_denied("Device %s is addressed to %s, not to %s", dev.IMEI, dev.ShippedTo, party)
+	}
+
+	// a missing device may only be claimed by the party its consignment was addressed to
+	if dev.Status == STATUS_IN_TRANSIT_MISSING {
+		c, found, err := t.get_consignment_record(stub, dev.ConsignmentNumber)
+		if err != nil { return change, err }
+		if found && !c.is_destination(callerAffiliation, party) {
+			return change, permission_denied("Device %s went missing on a consignment not addressed to %s", dev.IMEI, party)
+		}
+	}
+
+	named := make(map[string]string)
+	for i, name := range tr.Args { named[name] = args[i] }
+
+	for _, name := range tr.Private {
+		named[name], err = get_private_input(stub, name)
+		if err != nil { return change, err }
+	}
+
+	// a device is only shipped to a party registered for the role that accepts it
+	if source, ok := tr.Sets["shippedto"]; ok && strings.HasPrefix(source, SET_ARG) {
+		recipient := named[strings.TrimPrefix(source, SET_ARG)]
+		role, err := t.get_party_role(stub, recipient)
+		if err != nil { return change, err }
+		if role != tr.Recipient { return change, validation_failed("%s ships to a %s, %s is not registered as one", function, tr.Recipient, recipient) }
+	}
+
+	if tr.Customer != "" {
+		if strings.TrimSpace(named[tr.Customer]) == "" { return change, validation_failed("%s requires a customer id", function) }
+		owned, err := t.is_customer(stub, dev.IMEI, dev.OwnerID, named[tr.Customer])
+		if err != nil { return change, err }
+		if !owned { return change, permission_denied("Device %s does not belong to the customer named in %s", dev.IMEI, function) }
+	}
+
+	if tr.Counterpart != nil {
+		other, err := t.get_device(stub, named[tr.Counterpart.Arg])
+		if err != nil { fmt.Printf("RUN_TRANSITION: unable to get device %s", named[tr.Counterpart.Arg]); return change, err }
+
+		if other.Blacklisted != "" { return change, blacklisted(other) }
+
+		if other.Status != tr.Counterpart.From || (tr.Counterpart.Owner != "" && other.Owner != tr.Counterpart.Owner) {
+			fmt.Printf("RUN_TRANSITION: %s :: counterpart %s not eligible", function, other.IMEI)
+			e := invalid_transition(function, other, []DeviceState{{Status: tr.Counterpart.From, Owner: tr.Counterpart.Owner}})
+			e.Message = fmt.Sprintf("%s not allowed with device %s in status %s owned by %s", function, other.IMEI, other.Status, other.Owner)
+			return change, e
+		}
+
+		if tr.Counterpart.Owner == tr.Caller && other.OwnerID != "" && other.OwnerID != party {
+			return change, permission_denied("Device %s is held by %s, not by %s", other.IMEI, other.OwnerID, party)
+		}
+	}
+
+	now, err := t.tx_time(stub)
+	if err != nil { return change, err }
+
+	before := dev
+	for field, source := range tr.Sets {
+		value := source
+		if source == SET_NOW {
+			value = now.String()
+		} else if strings.HasPrefix(source, SET_ARG) {
+			value = named[strings.TrimPrefix(source, SET_ARG)]
+		} else if strings.HasPrefix(source, SET_CUSTOMER) {
+			customer := named[strings.TrimPrefix(source, SET_CUSTOMER)]
+			if strings.TrimSpace(customer) == "" { return change, validation_failed("%s requires a customer id", function) }
+			value, err = t.hash_customer(stub, dev.IMEI, customer)
+			if err != nil { return change, err }
+		} else if source == SET_TXID {
+			value = stub.GetTxID()
+		} else if source == SET_PARTY {
+			value = party
+		} else if source == SET_OWNERID {
+			value = before.OwnerID
+		} else if source == SET_WARRANTY {
+			policy, err := t.get_warranty_policy(stub, dev.DeviceModel)
+			if err != nil { return change, err }
+			value = policy.expiry(now).String()
+		}
+		err = dev.set_field(field, value)
+		if err != nil { return change, err }
+	}
+	for field, value := range extra {
+		err = dev.set_field(field, value)
+		if err != nil { return change, err }
+	}
+	dev.Status = tr.To
+
+	_, err = t.save_changes(stub, dev)
+
+	if err != nil { fmt.Printf("RUN_TRANSITION: error while updating the status"); return change, errors.New("error saving device details on " + function) }
+
+	toParty := tr.Recipient
+	if dev.Owner != before.Owner { toParty = dev.Owner }
+
+	err = t.append_history(stub, CustodyEvent{IMEI: dev.IMEI, Function: function, FromParty: before.Owner, ToParty: toParty,
+		StatusBefore: before.Status, StatusAfter: dev.Status, Consignment: dev.ConsignmentNumber, Timestamp: now})
+
+	if err != nil { fmt.Printf("RUN_TRANSITION: error recording custody event: %s", err); return change, err }
+
+	_, err = t.check_device_tac(stub, function, dev)
+
+	if err != nil { return change, err }
+	fmt.Printf(" %s :: completed", function)
+
+	change = DeviceChange{IMEI: dev.IMEI, Function: function, OldStatus: before.Status, NewStatus: dev.Status,
+		OldOwner: before.Owner, NewOwner: dev.Owner, Consignment: dev.ConsignmentNumber}
+	return change, nil
+}
+
+//=================================================================================================
+//  set_field -- assigns a Device field by its json name, as used in Transition.Sets
+//=================================================================================================
+
+func (d *Device) set_field(field string, value string) error {
+	switch field {
+	case "consignmentnumber":
+		d.ConsignmentNumber = value
+	case "dateofdelivery", "dateofreceipt", "dateofsale", "warrantyexpires":
+		date, err := parse_ledger_time(value)
+		if err != nil { return err }
+		if field == "dateofdelivery" {
+			d.DateOfDelivery = date
+		} else if field == "dateofreceipt" {
+			d.DateOfReceipt = date
+		} else if field == "dateofsale" {
+			d.DateOfSale = date
+		} else {
+			d.WarrantyExpires = date
+		}
+	case "oldimei":
+		d.OldIMEI = value
+	case "replaces":
+		d.Replaces = value
+	case "returnedby":
+		d.ReturnedBy = value
+	case "repair":
+		d.Repair = value
+	case "refurbished":
+		d.Refurbished = value == "true"
+	case "grade":
+		d.Grade = value
+	case "owner":
+		d.Owner = value
+	case "ownerid":
+		d.OwnerID = value
+	case "shippedto":
+		d.ShippedTo = value
+	case "sellingstore":
+		d.SellingStore = value
+	case "sale":
+		d.Sale = value
+	case "salehash":
+		d.SaleHash = value
+	default:
+		return errors.New("Transition cannot set device field " + field)
+	}
+	return nil
+}
+
+//=================================================================================================
+//  get_lifecycle -- exports the lifecycle table as JSON (default) or as a Graphviz DOT graph
+//=================================================================================================
+
+func (t *SimpleChainCode) get_lifecycle(stub shim.ChaincodeStubInterface, format string) ([]byte, error) {
+
+	if format == "dot" {
+		var buf bytes.Buffer
+		buf.WriteString("digraph lifecycle {\n")
+		for _, tr := range lifecycle {
+			guard := tr.Caller
+			if tr.Owner != "" { guard += ", owner " + tr.Owner }
+			if tr.Condition != "" { guard += ", " + strings.ToLower(tr.Condition) }
+			fmt.Fprintf(&buf, "  %q -> %q [label=%q];\n", tr.From, tr.To, tr.Function+"\n"+guard)
+			if tr.Counterpart != nil {
+				fmt.Fprintf(&buf, "  %q -> %q [label=%q, style=dashed];\n", tr.Counterpart.From, tr.Counterpart.To, tr.Function+"\n"+tr.Counterpart.Arg)
+			}
+		}
+		buf.WriteString("}\n")
+		return buf.Bytes(), nil
+	} else if format != "" && format != "json" {
+		return nil, validation_failed("Unknown lifecycle format %s", format)
+	}
+
+	var states []string
+	seen := make(map[string]bool)
+	for _, tr := range lifecycle {
+		edge := []string{tr.From, tr.To}
+		if tr.Counterpart != nil { edge = append(edge, tr.Counterpart.From, tr.Counterpart.To) }
+		for _, s := range edge {
+			if !seen[s] { seen[s] = true; states = append(states, s) }
+		}
+	}
+
+	graph, err := json.Marshal(struct {
+		States      []string     `json:"states"`
+		Transitions []Transition `json:"transitions"`
+	}{states, lifecycle})
+
+	if err != nil { return nil, errors.New("Error converting lifecycle") }
+	return graph, nil
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type test_step struct {
+	Caller   string
+	Function string
+	Args     []string // "$imei" is replaced by the device's IMEI, "$0", "$1", ... by scenario devices; "@id" is the customer id
+	Status   string
+	Owner    string
+}
+
+// to_vendor_and_back walks a device through every transition from the vendor to the customer and
+// back again; each step starts in the state the previous one left the device in
+var to_vendor_and_back = []test_step{
+	{VENDOR, "TRF_TO_WH", []string{"$imei", WAREHOUSE, "C1"}, STATUS_DELIVERED_TO_WAREHOUSE, VENDOR},
+	{WAREHOUSE, "ACPT_FROM_VENDOR", []string{"$imei", WAREHOUSE}, STATUS_RECEIVED, WAREHOUSE},
+	{WAREHOUSE, "TRF_TO_STRE", []string{"$imei", STORE, "C2"}, STATUS_DELIVERED_TO_STORE, WAREHOUSE},
+	{STORE, "ACPT_FROM_WAREHOUSE", []string{"$imei", STORE}, STATUS_RECEIVED, STORE},
+	{STORE, "TRF_TO_CUST", []string{"$imei", "@cust-42"}, STATUS_DELIVERED_TO_CUSTOMER, CUSTOMER},
+	{STORE, "RTN_FROM_CUST", []string{"$imei", STORE, "@cust-42"}, STATUS_RETURNED_TO_STORE, STORE},
+	{STORE, "RTN_TO_WAREHOUSE", []string{"$imei", WAREHOUSE, "C3"}, STATUS_RETURNED_TO_WAREHOUSE, STORE},
+	{WAREHOUSE, "ACPT_FROM_STRE", []string{"$imei", WAREHOUSE}, STATUS_RECEIVED, WAREHOUSE},
+	{WAREHOUSE, "RTN_TO_VENDOR", []string{"$imei", VENDOR, "C4"}, STATUS_RETURNED_TO_VENDOR, WAREHOUSE},
+	{VENDOR, "ACPT_RTN_FROM_WAREHOUSE", []string{"$imei", VENDOR}, STATUS_RECEIVED, VENDOR},
+}
+
+var roles = []string{VENDOR, WAREHOUSE, STORE, CUSTOMER}
+
+// step_args returns the arguments of a step and its customer id, which is not an argument
+func step_args(args []string, imeis []string) ([]string, string) {
+	out, customer := []string{}, ""
+	for _, a := range args {
+		if strings.HasPrefix(a, "@") { customer = a[1:]; continue }
+		if a == "$imei" { a = imeis[0] }
+		for j, imei := range imeis {
+			if a == "$"+string(rune('0'+j)) { a = imei }
+		}
+		out = append(out, a)
+	}
+	return out, customer
+}
+
+// with_customer passes the customer id of a step the way its function takes it: in the
+// SaleDetails of a sale, which the store makes, and in the customer field otherwise
+func (l *test_ledger) with_customer(function string, customer string) *test_ledger {
+	if customer == "" { return l }
+	if strings.HasPrefix(function, "TRF_TO_CUST") { return l.selling(STORE, customer) }
+	return l.for_customer(customer)
+}
+
+func (l *test_ledger) run_steps(steps []test_step, imeis ...string) {
+	l.t.Helper()
+	for _, s := range steps {
+		args, customer := step_args(s.Args, imeis)
+		l.as(s.Caller).with_customer(s.Function, customer).must(s.Function, args...)
+	}
+}
+
+//=================================================================================================
+//  Every transition is allowed for its caller in its From state and refused for any other caller
+//  and in any other state
+//=================================================================================================
+
+func TestTransitions(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	for i, step := range to_vendor_and_back {
+
+		t.Run(step.Function, func(t *testing.T) {
+
+			l.t = t
+			imei := l.create(1000 + i)
+			l.run_steps(to_vendor_and_back[:i], imei)
+
+			args, customer := step_args(step.Args, []string{imei})
+
+			for _, role := range roles {
+				if role == step.Caller { continue }
+				l.as(role).with_customer(step.Function, customer).fails(ERR_PERMISSION_DENIED, step.Function, args...)
+			}
+
+			// a fresh device in CREATED can only be shipped to the warehouse
+			if i > 0 {
+				other := l.create(2000 + i)
+				otherArgs, _ := step_args(step.Args, []string{other})
+				ce := l.as(step.Caller).with_customer(step.Function, customer).fails(ERR_INVALID_TRANSITION, step.Function, otherArgs...)
+				if ce.CurrentState == nil || ce.CurrentState.Status != STATUS_CREATED || len(ce.ExpectedState) == 0 {
+					t.Errorf("%s: error does not describe the states: %+v", step.Function, ce)
+				}
+			}
+
+			l.as(step.Caller).with_customer(step.Function, customer).must(step.Function, args...)
+
+			d := l.device(imei)
+			if d.Status != step.Status || d.Owner != step.Owner {
+				t.Errorf("%s: device is %s owned by %s, expected %s owned by %s", step.Function, d.Status, d.Owner, step.Status, step.Owner)
+			}
+
+			// the same transition cannot be taken twice in a row
+			l.as(step.Caller).with_customer(step.Function, customer).fails(ERR_INVALID_TRANSITION, step.Function, args...)
+		})
+	}
+}
+
+func TestTransitionArguments(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+
+	l.fails(ERR_VALIDATION_FAILED, "TRF_TO_WH", imei)
+	l.fails(ERR_VALIDATION_FAILED, "TRF_TO_WH", imei, WAREHOUSE, "C1", "extra")
+	l.fails(ERR_DEVICE_NOT_FOUND, "TRF_TO_WH", test_imei(2), WAREHOUSE, "C1")
+	l.fails(ERR_UNKNOWN_FUNCTION, "TRF_TO_MOON", imei)
+
+	// an IMEISV moves the device whose IMEI it contains
+	l.must("TRF_TO_WH", imei[:14]+"07", WAREHOUSE, "C1")
+	if d := l.device(imei); d.Status != STATUS_DELIVERED_TO_WAREHOUSE { t.Errorf("device %+v", d) }
+	l.as(WAREHOUSE).must("ACPT_FROM_VENDOR", imei[:14]+"07", WAREHOUSE)
+	if out := l.must("get_device_details", imei[:14]+"07"); !strings.Contains(out, `"imei":"`+imei+`"`) { t.Errorf("details %s", out) }
+}
+
+//=================================================================================================
+//  Scenarios -- whole journeys of one or more devices
+//=================================================================================================
+
+func TestScenarios(t *testing.T) {
+
+	warehouse := to_vendor_and_back[:2]
+	store := to_vendor_and_back[:4]
+	sale := to_vendor_and_back[:5]
+	returned := to_vendor_and_back[:6]
+
+	scenarios := []struct {
+		Name    string
+		Devices int
+		Setup   [][]test_step // per device
+		Steps   []test_step
+		Want    []DeviceState
+	}{
+		{Name: "sale", Devices: 1, Setup: [][]test_step{store},
+			Steps: []test_step{{STORE, "TRF_TO_CUST", []string{"$0", "@cust-42"}, "", ""}},
+			Want:  []DeviceState{{STATUS_DELIVERED_TO_CUSTOMER, CUSTOMER}}},
+
+		{Name: "customer return to the warehouse", Devices: 1, Setup: [][]test_step{sale},
+			Steps: []test_step{
+				{STORE, "RTN_FROM_CUST", []string{"$0", STORE, "@cust-42"}, "", ""},
+				{STORE, "RTN_TO_WAREHOUSE", []string{"$0", WAREHOUSE, "R1"}, "", ""},
+				{WAREHOUSE, "ACPT_FROM_STRE", []string{"$0", WAREHOUSE}, "", ""}},
+			Want: []DeviceState{{STATUS_RECEIVED, WAREHOUSE}}},
+
+		{Name: "exchange", Devices: 2, Setup: [][]test_step{returned, store},
+			Steps: []test_step{{STORE, "EXCHANGE_DEV", []string{"$1", "$0", "@cust-42"}, "", ""}},
+			Want:  []DeviceState{{STATUS_REPLACED, STORE}, {STATUS_EXCHANGED, CUSTOMER}}},
+
+		{Name: "return of an exchanged device", Devices: 2, Setup: [][]test_step{returned, store},
+			Steps: []test_step{
+				{STORE, "EXCHANGE_DEV", []string{"$1", "$0", "@cust-42"}, "", ""},
+				{STORE, "RTN_FROM_CUST", []string{"$1", STORE, "@cust-42"}, "", ""}},
+			Want: []DeviceState{{STATUS_REPLACED, STORE}, {STATUS_RETURNED_TO_STORE, STORE}}},
+
+		{Name: "exchanged device back to the warehouse", Devices: 2, Setup: [][]test_step{returned, store},
+			Steps: []test_step{
+				{STORE, "EXCHANGE_DEV", []string{"$1", "$0", "@cust-42"}, "", ""},
+				{STORE, "RTN_TO_WAREHOUSE", []string{"$0", WAREHOUSE, "R2"}, "", ""},
+				{WAREHOUSE, "ACPT_FROM_STRE", []string{"$0", WAREHOUSE}, "", ""}},
+			Want: []DeviceState{{STATUS_RECEIVED, WAREHOUSE}, {STATUS_EXCHANGED, CUSTOMER}}},
+
+		{Name: "vendor RMA", Devices: 1, Setup: [][]test_step{warehouse},
+			Steps: []test_step{
+				{WAREHOUSE, "RTN_TO_VENDOR", []string{"$0", VENDOR, "RMA1"}, "", ""},
+				{VENDOR, "ACPT_RTN_FROM_WAREHOUSE", []string{"$0", VENDOR}, "", ""}},
+			Want: []DeviceState{{STATUS_RECEIVED, VENDOR}}},
+	}
+
+	l := new_test_ledger(t)
+	serial := 100
+
+	for _, s := range scenarios {
+
+		t.Run(s.Name, func(t *testing.T) {
+
+			l.t = t
+			imeis := []string{}
+
+			for i := 0; i < s.Devices; i++ {
+				serial++
+				imeis = append(imeis, l.create(serial))
+				l.run_steps(s.Setup[i], imeis[i])
+			}
+
+			l.run_steps(s.Steps, imeis...)
+
+			for i, want := range s.Want {
+				d := l.device(imeis[i])
+				if d.Status != want.Status || d.Owner != want.Owner {
+					t.Errorf("device %d is %s owned by %s, expected %s owned by %s", i, d.Status, d.Owner, want.Status, want.Owner)
+				}
+			}
+		})
+	}
+}
+
+func TestSaleRecordsSeller(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+	l.run_steps(to_vendor_and_back[:5], imei)
+
+	var sale SaleRecord
+	if err := json.Unmarshal([]byte(l.must("get_sale", imei)), &sale); err != nil || sale.SoldBy != STORE { t.Errorf("sale not recorded: %+v", sale) }
+
+	d := l.device(imei)
+	if d.DateOfSale.IsZero() || strings.Contains(l.must("get_device_details", imei), `"soldby"`) { t.Errorf("seller is public: %+v", d) }
+	if d.OwnerID != customer_hash(test_secret, imei, "cust-42") || strings.Contains(l.must("get_device_history", imei), "cust-42") {
+		t.Errorf("customer id is stored in the clear: %+v", d)
+	}
+
+	// only the customer the device was sold to can return it
+	l.as(STORE).for_customer("cust-7").fails(ERR_PERMISSION_DENIED, "RTN_FROM_CUST", imei, STORE)
+	l.fails(ERR_VALIDATION_FAILED, "RTN_FROM_CUST", imei, STORE)
+	l.for_customer(" cust-42 ").must("RTN_FROM_CUST", imei, STORE)
+}
+
+func TestMigrateOwners(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+	l.run_steps(to_vendor_and_back[:4], imei)
+
+	// a sale recorded before owner ids: the customer's name is the owner
+	d := l.device(imei)
+	d.Status, d.Owner = STATUS_DELIVERED_TO_CUSTOMER, "Jane Doe"
+	l.begin()
+	if _, err := l.cc.save_changes(l.stub, d); err != nil { t.Fatal(err) }
+	l.end()
+
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "migrate_owners")
+	l.as(VENDOR).must("migrate_owners")
+
+	if d = l.device(imei); d.Owner != CUSTOMER || d.OwnerID != customer_hash(test_secret, imei, "Jane Doe") { t.Fatalf("not migrated: %+v", d) }
+
+	l.as(STORE).for_customer("Jane Doe").must("RTN_FROM_CUST", imei, STORE)
+}
+
+func TestExchangeKeepsHistory(t *testing.T) {
+
+	l := new_test_ledger(t)
+	old, replacement := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:6], old)
+	l.run_steps(to_vendor_and_back[:4], replacement)
+
+	l.as(STORE).for_customer("cust-42").must("EXCHANGE_DEV", replacement, old)
+
+	var history []CustodyEvent
+	if err := json.Unmarshal([]byte(l.must("get_device_history", replacement)), &history); err != nil { t.Fatal(err) }
+
+	if len(history) == 0 || history[0].IMEI != old { t.Fatalf("history does not start with the exchanged device: %+v", history) }
+	if last := history[len(history)-1]; last.Function != "EXCHANGE_DEV" || last.IMEI != replacement {
+		t.Errorf("history does not end with the exchange: %+v", last)
+	}
+}
+
+func TestExchange(t *testing.T) {
+
+	l := new_test_ledger(t)
+	old, same, other := l.create(1), l.create(2), test_imei(3)
+	l.must("create_device", other, "LENOVO", "K8", "2016-12-03")
+	l.run_steps(to_vendor_and_back[:6], old)
+	l.run_steps(to_vendor_and_back[:4], same)
+	l.run_steps(to_vendor_and_back[:4], other)
+	l.as(STORE)
+
+	// only the customer who returned the device can exchange it
+	if d := l.device(old); d.ReturnedBy != customer_hash(test_secret, old, "cust-42") { t.Errorf("returning customer not kept: %+v", d) }
+	l.for_customer("cust-7").fails(ERR_PERMISSION_DENIED, "EXCHANGE_DEV", same, old)
+	l.fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", same, old)
+
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", other, old)
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", same, old, "upgrade", "50")
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", same, old, "like_for_like", "50")
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", other, old, "upgrade", "")
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", other, old, "upgrade", "-5")
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", other, old, "swap", "")
+
+	// another store cannot take in the device returned here
+	theirs := l.create(4)
+	l.run_steps(to_vendor_and_back[:4], theirs)
+	d := l.device(theirs)
+	d.OwnerID = "STORE2"
+	l.begin()
+	if _, err := l.cc.save_changes(l.stub, d); err != nil { t.Fatal(err) }
+	l.end()
+	l.as_party(STORE, "STORE2").for_customer("cust-42").fails(ERR_PERMISSION_DENIED, "EXCHANGE_DEV", theirs, old)
+	if d := l.device(old); d.Status != STATUS_RETURNED_TO_STORE || d.ReplacedBy != "" { t.Errorf("returned device taken by another store: %+v", d) }
+	l.as(STORE)
+
+	var x Exchange
+	if err := json.Unmarshal([]byte(l.for_customer("cust-42").must("EXCHANGE_DEV", other, old, "upgrade", "49.90")), &x); err != nil { t.Fatal(err) }
+	if x.Type != EXCHANGE_UPGRADE || x.PriceDifference != "49.90" || x.OldModel != "VIBE" || x.NewModel != "K8" {
+		t.Errorf("exchange record %+v", x)
+	}
+
+	// both devices were updated and link to each other
+	o, n := l.device(old), l.device(other)
+	if o.Status != STATUS_REPLACED || o.ReplacedBy != other || n.Replaces != old || n.OldIMEI != old {
+		t.Errorf("devices not linked: %+v, %+v", o, n)
+	}
+	if l.must("get_exchange", old) != l.must("get_exchange", other) { t.Errorf("exchange not found from both devices") }
+
+	// the new device is sold to the customer for the difference
+	var sale SaleRecord
+	if err := json.Unmarshal([]byte(l.must("get_sale", other)), &sale); err != nil || sale.Customer != "cust-42" || sale.SalePrice != "49.90" || sale.Store != STORE {
+		t.Errorf("sale of the new device %+v", sale)
+	}
+	l.fails(ERR_NOT_FOUND, "get_exchange", same)
+
+	// the returned device is gone from the shelf and cannot be handed in twice
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", same, old)
+
+	var e LifecycleEvent
+	if err := json.Unmarshal(l.events[len(l.events)-1].Payload, &e); err != nil || len(e.Changes) != 2 { t.Errorf("event %+v", e) }
+}
+
+func TestExchangeWindow(t *testing.T) {
+
+	l := new_test_ledger(t)
+	old, replacement := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:6], old)
+	l.run_steps(to_vendor_and_back[:4], replacement)
+
+	// the device was sold a day more than the window ago
+	d := l.device(old)
+	d.DateOfSale = LedgerTime{d.DateOfSale.AddDate(0, 0, -EXCHANGE_WINDOW_DAYS-1)}
+	l.begin()
+	if _, err := l.cc.save_changes(l.stub, d); err != nil { t.Fatal(err) }
+	l.end()
+
+	l.as(STORE).for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", replacement, old)
+
+	if d := l.device(replacement); d.Status != STATUS_RECEIVED { t.Errorf("refused exchange changed the replacement: %+v", d) }
+}
+
+func TestRepair(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei, scrap := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back, imei)
+	l.run_steps(to_vendor_and_back, scrap)
+
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "START_REPAIR", imei, "RepairCo", "no power")
+	l.as(VENDOR).fails(ERR_INVALID_TRANSITION, "START_REPAIR", l.create(3), "RepairCo", "no power")
+	l.must("START_REPAIR", imei, "RepairCo", "no power")
+
+	if d := l.device(imei); d.Status != STATUS_IN_REPAIR || d.Repair == "" { t.Fatalf("repair not started: %+v", d) }
+
+	l.fails(ERR_VALIDATION_FAILED, "REFURBISH_DEV", imei, "Z", `["battery"]`)
+	l.fails(ERR_VALIDATION_FAILED, "REFURBISH_DEV", imei, "B", "battery")
+	l.must("REFURBISH_DEV", imei, "b", `["battery","back cover"]`)
+
+	d := l.device(imei)
+	if d.Status != STATUS_REFURBISHED || !d.Refurbished || d.Grade != "B" || d.Repair != "" { t.Errorf("not refurbished: %+v", d) }
+
+	var repairs []RepairRecord
+	if err := json.Unmarshal([]byte(l.must("get_repairs", imei)), &repairs); err != nil || len(repairs) != 1 { t.Fatalf("repairs %v", repairs) }
+	if r := repairs[0]; r.Outcome != REPAIR_REFURBISHED || r.Technician != "RepairCo" || len(r.PartsReplaced) != 2 || r.FinishedAt.IsZero() {
+		t.Errorf("repair record %+v", r)
+	}
+
+	// back into the supply chain, but not as a new device
+	l.run_steps(to_vendor_and_back[:4], imei)
+	if ce := l.as(STORE).selling(STORE, "cust-42").fails(ERR_INVALID_TRANSITION, "TRF_TO_CUST", imei); !strings.Contains(ce.Message, "refurbished") {
+		t.Errorf("refusal does not say why: %s", ce.Message)
+	}
+	l.selling(STORE, "cust-42").must("TRF_TO_CUST_REFURB", imei)
+
+	fresh := l.create(4)
+	l.run_steps(to_vendor_and_back[:4], fresh)
+	l.as(STORE).selling(STORE, "cust-42").fails(ERR_INVALID_TRANSITION, "TRF_TO_CUST_REFURB", fresh)
+
+	l.as(VENDOR).must("START_REPAIR", scrap, "RepairCo", "water damage")
+	l.must("SCRAP_DEV", scrap, "board corroded")
+	l.fails(ERR_INVALID_TRANSITION, "TRF_TO_WH", scrap, WAREHOUSE, "C9")
+
+	if err := json.Unmarshal([]byte(l.must("get_repairs", scrap)), &repairs); err != nil || repairs[0].Outcome != REPAIR_SCRAPPED { t.Errorf("scrapped %+v", repairs) }
+}
+
+func TestLifecycleEvents(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+	l.events = nil
+
+	l.run_steps(to_vendor_and_back[:2], imei)
+
+	if len(l.events) != 2 { t.Fatalf("expected an event per transition, got %d", len(l.events)) }
+
+	var e LifecycleEvent
+	if err := json.Unmarshal(l.events[1].Payload, &e); err != nil { t.Fatal(err) }
+
+	if l.events[1].Name != LIFECYCLE_EVENT || e.Function != "ACPT_FROM_VENDOR" || len(e.Changes) != 1 ||
+		e.Changes[0].OldOwner != VENDOR || e.Changes[0].NewOwner != WAREHOUSE {
+		t.Errorf("unexpected event %s", l.events[1].Payload)
+	}
+}
+
+func TestGetLifecycle(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	if dot := l.must("get_lifecycle", "dot"); !strings.HasPrefix(dot, "digraph") { t.Errorf("not a DOT graph: %s", dot) }
+
+	l.fails(ERR_VALIDATION_FAILED, "get_lifecycle", "svg")
+}
+
+func TestCustomerSecret(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+	l.run_steps(to_vendor_and_back[:5], imei)
+
+	// the owner id cannot be recomputed from the IMEI and a guessed customer id alone
+	unkeyed := sha256.Sum256([]byte(imei + "\u0000cust-42"))
+	if d := l.device(imei); d.OwnerID == hex.EncodeToString(unkeyed[:]) { t.Errorf("owner id is not keyed: %+v", d) }
+
+	for _, c := range []struct{ Role, Secret, Code string }{
+		{STORE, "another secret of at least 32 bytes", ERR_PERMISSION_DENIED},
+		{VENDOR, "another secret of at least 32 bytes", ERR_ALREADY_EXISTS},
+		{VENDOR, "short", ERR_VALIDATION_FAILED},
+	} {
+		l.stub.TransientMap = map[string][]byte{TRANSIENT_CUSTOMER_SECRET: []byte(c.Secret)}
+		l.as(c.Role).fails(c.Code, "set_customer_secret")
+	}
+
+	l.as(STORE).for_customer("cust-7").fails(ERR_PERMISSION_DENIED, "RTN_FROM_CUST", imei, STORE)
+	l.for_customer("cust-42").must("RTN_FROM_CUST", imei, STORE)
+}
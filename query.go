@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 50
+	MAX_PAGE_SIZE     = 500
+
+	// a page reads at most this many index entries per device it may return
+	PAGE_SCAN_FACTOR = 4
+)
+
+//=================================================================================================
+//  DeviceFilter -- the JSON argument of get_devices. Every field is optional. Bookmark is the IMEI
+//  the page starts at, as returned in the previous page with the same filter; From and To bound
+//  the date named by DateField (dateofmanf, dateofdelivery, dateofreceipt, dateofsale or
+//  warrantyexpires) and are both inclusive. SellingStore is the party of the store that sold the
+//  device. A filter on Status, Owner or DeviceModel is served from that secondary index, so the
+//  value must match exactly; the other criteria are checked on the devices read.
+//=================================================================================================
+
+type DeviceFilter struct {
+	PageSize     int    `json:"pagesize"`
+	Bookmark     string `json:"bookmark"`
+	Status       string `json:"status"`
+	Owner        string `json:"owner"`
+	DeviceModel  string `json:"devicemodel"`
+	DeviceName   string `json:"devicename"`
+	SellingStore string `json:"sellingstore"`
+	DateField    string `json:"datefield"`
+	From         string `json:"from"`
+	To           string `json:"to"`
+
+	from LedgerTime
+	to   LedgerTime
+}
+
+//=================================================================================================
+//  DevicePage -- the response of get_devices. Count is the number of devices on this page, which
+//  may be short of the page size, or empty, while More is set; the next page starts at Bookmark.
+//  Errors names records that could not be read.
+//=================================================================================================
+
+type DevicePage struct {
+	Count    int      `json:"count"`
+	More     bool     `json:"more"`
+	Bookmark string   `json:"bookmark"`
+	Devices  []Device `json:"devices"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+//=================================================================================================
+//  parse_device_filter -- decodes and validates a DeviceFilter, rejecting unknown fields
+//=================================================================================================
+
+func parse_device_filter(value string) (DeviceFilter, error) {
+
+	var f DeviceFilter
+
+	if strings.TrimSpace(value) != "" {
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+
+		err := decoder.Decode(&f)
+
+		if err != nil { return f, validation_failed("Invalid device filter: %s", err) }
+	}
+
+	if f.PageSize == 0 { f.PageSize = DEFAULT_PAGE_SIZE }
+
+	if f.PageSize < 0 || f.PageSize > MAX_PAGE_SIZE { return f, validation_failed("Page size must be between 1 and %d", MAX_PAGE_SIZE) }
+
+	if f.From != "" || f.To != "" {
+		if _, ok := (Device{}).date_field(f.DateField); !ok { return f, validation_failed("Invalid date field %s", f.DateField) }
+
+		var err error
+
+		f.from, err = parse_ledger_time(f.From)
+		if err != nil { return f, validation_failed("Invalid from date: %s", err) }
+
+		f.to, err = parse_ledger_time(f.To)
+		if err != nil { return f, validation_failed("Invalid to date: %s", err) }
+	}
+
+	return f, nil
+}
+
+//=================================================================================================
+//  matches -- reports whether a device satisfies every criterion set in the filter
+//=================================================================================================
+
+func (f DeviceFilter) matches(d Device) bool {
+
+	if f.Status != "" && d.Status != f.Status { return false }
+	if f.Owner != "" && d.Owner != f.Owner { return false }
+	if f.DeviceModel != "" && d.DeviceModel != f.DeviceModel { return false }
+	if f.DeviceName != "" && !strings.EqualFold(d.DeviceName, f.DeviceName) { return false }
+	if f.SellingStore != "" && d.SellingStore != f.SellingStore { return false }
+
+	if f.From != "" || f.To != "" {
+		date, _ := d.date_field(f.DateField)
+		if date.IsZero() { return false }
+		if !f.from.IsZero() && date.Before(f.from.Time) { return false }
+		if !f.to.IsZero() && date.After(f.to.Time) { return false }
+	}
+
+	return true
+}
+
+//=================================================================================================
+//  date_field -- returns a Device date by its json name
+//=================================================================================================
+
+func (d Device) date_field(field string) (LedgerTime, bool) {
+	switch field {
+	case "dateofmanf":
+		return d.DateOfManf, true
+	case "dateofdelivery":
+		return d.DateOfDelivery, true
+	case "dateofreceipt":
+		return d.DateOfReceipt, true
+	case "dateofsale":
+		return d.DateOfSale, true
+	case "warrantyexpires":
+		return d.WarrantyExpires, true
+	}
+	return LedgerTime{}, false
+}
+
+//=================================================================================================
+//  index -- the index a filter is served from and the leading attributes of its entries: the
+//  status, owner or model index when the filter names one, otherwise the devices themselves
+//=================================================================================================
+
+func (f DeviceFilter) index() (string, []string) {
+	switch {
+	case f.Status != "":
+		return STATUS_INDEX, []string{f.Status}
+	case f.Owner != "":
+		return OWNER_INDEX, []string{f.Owner}
+	case f.DeviceModel != "":
+		return MODEL_INDEX, []string{f.DeviceModel}
+	}
+	return DEVICE_INDEX, nil
+}
+
+//=================================================================================================
+//  listed_device -- the device an entry of index stands for. DEVICE_INDEX entries hold the device,
+//  those of the secondary indexes end in its IMEI.
+//=================================================================================================
+
+func (t *SimpleChainCode) listed_device(stub shim.ChaincodeStubInterface, index string, imei string, value []byte) (Device, error) {
+
+	var dev Device
+
+	if index != DEVICE_INDEX { return t.get_device(stub, imei) }
+
+	err := json.Unmarshal(value, &dev)
+
+	if err != nil { fmt.Printf("LISTED_DEVICE: unable to read %s: %s", imei, err); return dev, errors.New("Unable to read device " + imei) }
+
+	return dev, nil
+}
+
+//=================================================================================================
+//  get_devices -- returns one page of the devices the reader may read matching a DeviceFilter, in
+//  IMEI order. Only the entries of the index serving the filter are read, a page at a time from
+//  the bookmark on; entries the reader may not read or that fail the other criteria are skipped
+//  and replaced from the next page until this one is full, the index is exhausted or
+//  PAGE_SCAN_FACTOR entries per requested device have been read.
+//=================================================================================================
+
+func (t *SimpleChainCode) get_devices(stub shim.ChaincodeStubInterface, r Reader, filter string) ([]byte, error) {
+
+	f, err := parse_device_filter(filter)
+
+	if err != nil { return nil, err }
+
+	index, attributes := f.index()
+
+	bookmark := ""
+
+	if f.Bookmark != "" {
+		bookmark, err = create_composite_key(stub, index, append(attributes, f.Bookmark)...)
+		if err != nil { return nil, err }
+	}
+
+	page := DevicePage{Devices: []Device{}}
+
+	scanned, limit := 0, f.PageSize*PAGE_SCAN_FACTOR
+
+	for page.Count < f.PageSize && scanned < limit {
+
+		size := f.PageSize - page.Count
+		if size > limit-scanned { size = limit - scanned }
+
+		iter, meta, err := stub.GetStateByPartialCompositeKeyWithPagination(index, attributes, int32(size), bookmark)
+
+		if err != nil || iter == nil || meta == nil { fmt.Printf("GET_DEVICES: paginated query on %s failed: %v", index, err); return nil, errors.New("Unable to list devices") }
+
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil { iter.Close(); return nil, errors.New("Unable to list devices") }
+
+			scanned++
+
+			entry, err := split_composite_key(stub, kv.Key)
+			if err != nil || len(entry) == 0 { page.Errors = append(page.Errors, kv.Key); continue }
+
+			imei := entry[len(entry)-1]
+
+			dev, err := t.listed_device(stub, index, imei, kv.Value)
+			if err != nil { page.Errors = append(page.Errors, imei); continue }
+
+			if r.view(dev) != VIEW_FULL || !f.matches(dev) { continue }
+
+			page.Devices = append(page.Devices, dev)
+			page.Count++
+		}
+
+		iter.Close()
+
+		bookmark = meta.Bookmark
+
+		if bookmark == "" { break }
+	}
+
+	if bookmark != "" {
+		entry, err := split_composite_key(stub, bookmark)
+		if err != nil || len(entry) == 0 { return nil, errors.New("Invalid bookmark returned by the ledger") }
+		page.Bookmark = entry[len(entry)-1]
+		page.More = true
+	}
+
+	bytes, err := json.Marshal(page)
+
+	if err != nil { return nil, errors.New("Error converting device page") }
+
+	return bytes, nil
+}
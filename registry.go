@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const (
+	FUNCTION_INVOKE = "invoke"
+	FUNCTION_QUERY  = "query"
+)
+
+// Argument types checked before a function runs. ARG_STRING accepts any value, the others must be
+// non-empty and well formed. An ARG_IMEI given as a 16 digit IMEISV is passed on as the IMEI it
+// contains; ARG_IMEISV is passed on as given, for the functions that keep the software version.
+const (
+	ARG_STRING = "string"
+	ARG_IMEI   = "imei"
+	ARG_IMEISV = "imeisv"
+	ARG_JSON   = "json"
+	ARG_DATE   = "date"
+)
+
+type ArgSpec struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+type handler func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error)
+
+//=================================================================================================
+//  FunctionSpec -- a function callable through Invoke or Query. Forms lists the argument lists the
+//  function accepts; the first form whose length fits is used to check the arguments. If Roles is
+//  set only those affiliations may call it. Queries only read the caller's identity when
+//  NeedsCaller is set.
+//=================================================================================================
+
+type FunctionSpec struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Description string      `json:"description"`
+	Roles       []string    `json:"roles,omitempty"`
+	Forms       [][]ArgSpec `json:"forms"`
+	NeedsCaller bool        `json:"-"`
+	run         handler
+}
+
+var registry = map[string]FunctionSpec{}
+
+func register(spec FunctionSpec) {
+	if spec.Forms == nil { spec.Forms = [][]ArgSpec{{}} }
+	registry[spec.Name] = spec
+}
+
+func arg(name string, argType string) ArgSpec { return ArgSpec{Name: name, Type: argType} }
+
+func optional(name string, argType string) ArgSpec { return ArgSpec{Name: name, Type: argType, Optional: true} }
+
+// optional_arg returns args[i], or "" when the optional argument was left out
+func optional_arg(args []string, i int) string {
+	if i < len(args) { return args[i] }
+	return ""
+}
+
+func init() {
+
+	register(FunctionSpec{Name: "create_device", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Creates a device from a JSON DeviceSpec, from an IMEI and the default template, or from the form fields",
+		Forms: [][]ArgSpec{{arg("spec", ARG_STRING)},
+			{arg("imei", ARG_IMEISV), arg("devicename", ARG_STRING), arg("devicemodel", ARG_STRING), arg("dateofmanf", ARG_DATE)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			if len(args) == 4 { return t.createDeviceUsingForm(stub, args) }
+			if strings.HasPrefix(strings.TrimSpace(args[0]), "{") { return t.createDevice(stub, args[0]) }
+			return t.createDeviceFromTemplate(stub, args[0], DEFAULT_TEMPLATE)
+		}})
+
+	register(FunctionSpec{Name: "create_device_from_template", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Creates a device from a stored template",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEISV), optional("template", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			template := optional_arg(args, 1)
+			if template == "" { template = DEFAULT_TEMPLATE }
+			return t.createDeviceFromTemplate(stub, args[0], template)
+		}})
+
+	register(FunctionSpec{Name: "create_devices_batch", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Creates every device of a JSON or CSV manifest, or none of them",
+		Forms: [][]ArgSpec{{arg("manifest", ARG_STRING), optional("format", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.create_devices_batch(stub, args[0], optional_arg(args, 1))
+		}})
+
+	register(FunctionSpec{Name: "set_device_template", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Stores a device template; an empty dateofmanf means the creation date",
+		Forms: [][]ArgSpec{{arg("name", ARG_STRING), arg("devicename", ARG_STRING), arg("devicemodel", ARG_STRING), arg("dateofmanf", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.set_device_template(stub, DeviceTemplate{Name: args[0], DeviceName: args[1], DeviceModel: args[2], DateOfManf: args[3]})
+		}})
+
+	register(FunctionSpec{Name: "register_party", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Registers the role callers signing with an MSP may act in, a supply chain role or CUSTOMER",
+		Forms: [][]ArgSpec{{arg("mspid", ARG_STRING), arg("role", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.register_party(stub, args[0], args[1])
+		}})
+
+	register(FunctionSpec{Name: "register_tac", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Registers the device name and model a Type Allocation Code belongs to",
+		Forms: [][]ArgSpec{{arg("tac", ARG_STRING), arg("devicename", ARG_STRING), arg("devicemodel", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.register_tac(stub, TAC_Record{TAC: args[0], DeviceName: args[1], DeviceModel: args[2]})
+		}})
+
+	register(FunctionSpec{Name: "DISPATCH_CONSIGNMENT", Type: FUNCTION_INVOKE,
+		Description: "Ships a JSON list of devices to destination under one consignment",
+		Forms: [][]ArgSpec{{arg("consignment", ARG_STRING), arg("destination", ARG_STRING), arg("carrier", ARG_STRING), arg("recipient", ARG_STRING), arg("imeis", ARG_JSON)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			imeis, err := parse_imei_list(args[4])
+			if err != nil { return nil, err }
+			return t.dispatch_consignment(stub, callerAffiliation, Consignment{Number: args[0], Destination: args[1], Carrier: args[2], Recipient: args[3]}, imeis)
+		}})
+
+	register(FunctionSpec{Name: "ACPT_CONSIGNMENT", Type: FUNCTION_INVOKE,
+		Description: "Accepts a consignment, or the devices of it listed in scanned",
+		Forms: [][]ArgSpec{{arg("consignment", ARG_STRING), optional("scanned", ARG_JSON)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			var scanned []ScannedDevice
+			if len(args) == 2 {
+				var err error
+				scanned, err = parse_scan_list(args[1])
+				if err != nil { return nil, err }
+			}
+			return t.accept_consignment(stub, callerAffiliation, args[0], scanned)
+		}})
+
+	register(FunctionSpec{Name: "resolve_discrepancy", Type: FUNCTION_INVOKE,
+		Description: "Closes a discrepancy case opened on a consignment",
+		Forms: [][]ArgSpec{{arg("consignment", ARG_STRING), arg("id", ARG_STRING), arg("resolution", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			return t.resolve_discrepancy(stub, callerAffiliation, args[0], args[1], args[2])
+		}})
+
+	register(FunctionSpec{Name: "migrate_imei_index", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Moves devices stored under their bare IMEI to the device~imei key",
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, _ []string) ([]byte, error) {
+			return t.migrate_imei_index(stub)
+		}})
+
+	register(FunctionSpec{Name: "rebuild_indexes", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Writes the secondary index entries of every device",
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, _ []string) ([]byte, error) {
+			return t.rebuild_indexes(stub)
+		}})
+
+	register(FunctionSpec{Name: "set_customer_secret", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Sets the secret customer ids are hashed with, passed in the transient field customersecret",
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, _ []string) ([]byte, error) {
+			return t.set_customer_secret(stub)
+		}})
+
+	register(FunctionSpec{Name: "migrate_owners", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Moves customer names stored as owner into hashed owner ids",
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, _ []string) ([]byte, error) {
+			return t.migrate_owners(stub)
+		}})
+
+	register(FunctionSpec{Name: "migrate_sellers", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Moves the sellers devices recorded in the clear into private sale records",
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, _ []string) ([]byte, error) {
+			return t.migrate_sellers(stub)
+		}})
+
+	register(FunctionSpec{Name: "migrate_dates", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Rewrites stored dates in RFC 3339",
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, _ []string) ([]byte, error) {
+			return t.migrate_dates(stub)
+		}})
+
+	register(FunctionSpec{Name: "set_warranty_policy", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: fmt.Sprintf("Sets the warranty term of a device model in months; models without one have %d", DEFAULT_WARRANTY_MONTHS),
+		Forms: [][]ArgSpec{{arg("devicemodel", ARG_STRING), arg("months", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.set_warranty_policy(stub, args[0], args[1])
+		}})
+
+	register(FunctionSpec{Name: "file_warranty_claim", Type: FUNCTION_INVOKE, Roles: []string{STORE},
+		Description: "Opens a warranty claim with a JSON list of fault codes for the customer a device was sold to, whose id is passed in the transient field " + TRANSIENT_CUSTOMER,
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI), arg("faultcodes", ARG_JSON), optional("description", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			customer, err := get_customer(stub)
+			if err != nil { return nil, err }
+			return t.file_warranty_claim(stub, callerAffiliation, args[0], customer, args[1], optional_arg(args, 2))
+		}})
+
+	register(FunctionSpec{Name: "update_warranty_claim", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Approves or rejects an open warranty claim, or records the repair of an approved one",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI), arg("id", ARG_STRING), arg("status", ARG_STRING), optional("note", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			return t.update_warranty_claim(stub, callerAffiliation, args[0], args[1], args[2], optional_arg(args, 3))
+		}})
+
+	for _, r := range []struct{ Name, Reason string }{{"report_stolen", REPORT_STOLEN}, {"report_lost", REPORT_LOST}} {
+		reason := r.Reason
+		register(FunctionSpec{Name: r.Name, Type: FUNCTION_INVOKE,
+			Description: "Blacklists a device as " + strings.ToLower(reason) + "; a store reporting for a customer passes the customer id in the transient field " + TRANSIENT_CUSTOMER,
+			Forms: [][]ArgSpec{{arg("imei", ARG_IMEI), arg("reference", ARG_STRING)}},
+			run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+				customer, err := get_customer(stub)
+				if err != nil { return nil, err }
+				return t.report_device(stub, callerAffiliation, reason, args[0], args[1], customer)
+			}})
+	}
+
+	register(FunctionSpec{Name: "clear_report", Type: FUNCTION_INVOKE,
+		Description: "Takes a device off the blacklist",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI), arg("resolution", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			return t.clear_report(stub, callerAffiliation, args[0], args[1])
+		}})
+
+	register(FunctionSpec{Name: "report_sighting", Type: FUNCTION_INVOKE, Roles: []string{VENDOR, WAREHOUSE, STORE},
+		Description: "Records that the caller has a device in hand, raising CLONE_SUSPECTED if the ledger places it elsewhere; returns its blacklist status",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			customer, err := get_customer(stub)
+			if err != nil { return nil, err }
+			return t.report_sighting(stub, callerAffiliation, args[0], customer)
+		}})
+
+	register(FunctionSpec{Name: "scan_anomalies", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Checks the custody chain and TAC of every device and raises alerts for the anomalies found",
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, _ []string) ([]byte, error) {
+			return t.scan_anomalies(stub)
+		}})
+
+	register(FunctionSpec{Name: "close_alert", Type: FUNCTION_INVOKE, Roles: []string{VENDOR},
+		Description: "Closes an alert with the outcome of its investigation",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI), arg("id", ARG_STRING), arg("resolution", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.close_alert(stub, args[0], args[1], args[2])
+		}})
+
+	exchange := lifecycle_spec("EXCHANGE_DEV")
+	exchange.Description = fmt.Sprintf("Hands a customer a device for one they returned within %d days of the sale, "+
+		"like for like or as an upgrade with the price difference paid; the customer id is passed in the transient field %s",
+		EXCHANGE_WINDOW_DAYS, TRANSIENT_CUSTOMER)
+	exchange.Forms[0] = append(exchange.Forms[0], optional("type", ARG_STRING), optional("pricedifference", ARG_STRING))
+	exchange.run = func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+		return t.exchange_device(stub, callerAffiliation, args)
+	}
+	register(exchange)
+
+	for _, function := range []string{"START_REPAIR", "REFURBISH_DEV", "SCRAP_DEV"} {
+		name := function
+		spec := lifecycle_spec(name)
+		for i := range spec.Forms[0] {
+			if spec.Forms[0][i].Name == "parts" { spec.Forms[0][i].Type = ARG_JSON }
+		}
+		spec.run = func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			return t.repair_transition(stub, callerAffiliation, name, args)
+		}
+		register(spec)
+	}
+
+	for _, function := range []string{"TRF_TO_CUST", "TRF_TO_CUST_REFURB"} {
+		name := function
+		spec := lifecycle_spec(name)
+		spec.Description += "; the sale details, with the customer id and the seller, are passed in the transient field " + TRANSIENT_SALE
+		spec.run = func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			return t.sale_transition(stub, callerAffiliation, name, args)
+		}
+		register(spec)
+	}
+
+	for _, tr := range lifecycle {
+		if _, done := registry[tr.Function]; done || tr.Internal { continue }
+		register(lifecycle_spec(tr.Function))
+	}
+
+	register(FunctionSpec{Name: "get_device_details", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Returns a device, or its redacted summary to a party its read policy does not cover",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			d, err := t.get_device(stub, args[0])
+			if err != nil { return nil, err }
+			return t.get_dev_details(r, d)
+		}})
+
+	register(FunctionSpec{Name: "check_unique_imei", Type: FUNCTION_QUERY,
+		Description: "Reports whether no device is stored under the IMEI",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.check_unique_imei(stub, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_devices", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Returns one page of the devices the caller may read matching a JSON DeviceFilter",
+		Forms: [][]ArgSpec{{optional("filter", ARG_JSON)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			return t.get_devices(stub, r, optional_arg(args, 0))
+		}})
+
+	for _, q := range []struct{ Name, Arg, Index string }{
+		{"get_devices_by_owner", "owner", OWNER_INDEX},
+		{"get_devices_by_status", "status", STATUS_INDEX},
+		{"get_consignment_contents", "consignment", CONSIGNMENT_INDEX},
+	} {
+		index := q.Index
+		register(FunctionSpec{Name: q.Name, Type: FUNCTION_QUERY, NeedsCaller: true,
+			Description: "Returns the devices the caller may read with the given " + q.Arg,
+			Forms: [][]ArgSpec{{arg(q.Arg, ARG_STRING)}},
+			run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+				r, err := t.get_reader(stub, callerAffiliation)
+				if err != nil { return nil, err }
+				return t.get_devices_by_index(stub, r, index, args[0])
+			}})
+	}
+
+	register(FunctionSpec{Name: "get_consignment", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Returns a consignment to its origin or destination, or its redacted summary to another party",
+		Forms: [][]ArgSpec{{arg("consignment", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			return t.get_consignment(stub, r, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_discrepancies", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Returns the discrepancy cases of a consignment to its origin or destination",
+		Forms: [][]ArgSpec{{arg("consignment", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			return t.get_discrepancies(stub, callerAffiliation, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_device_history", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Returns the custody chain of a device, including the devices it replaced, redacted outside the read policy",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			return t.get_device_history(stub, r, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_exchange", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Returns the exchange a device was returned or handed out in, redacted outside the read policy",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			return t.get_exchange(stub, r, args[0])
+		}})
+
+	register(FunctionSpec{Name: "check_warranty", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Reports whether a device is under warranty on a date, by default today",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI), optional("date", ARG_DATE)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			return t.check_warranty(stub, r, args[0], optional_arg(args, 1))
+		}})
+
+	register(FunctionSpec{Name: "get_warranty_claims", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Returns the warranty claims filed on a device, redacted outside the read policy",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			return t.get_warranty_claims(stub, r, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_repairs", Type: FUNCTION_QUERY, NeedsCaller: true,
+		Description: "Returns the repair records of a device, redacted outside the read policy",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			return t.get_repairs(stub, r, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_sale", Type: FUNCTION_QUERY, Roles: []string{VENDOR, STORE},
+		Description: "Returns the private record of the last sale of a device to a party its read policy covers",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+			r, err := t.get_reader(stub, callerAffiliation)
+			if err != nil { return nil, err }
+			return t.get_sale(stub, r, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_store_margin", Type: FUNCTION_QUERY, Roles: []string{STORE},
+		Description: "Returns what the store paid for a device and made on its last sale",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.get_store_margin(stub, args[0])
+		}})
+
+	register(FunctionSpec{Name: "check_blacklist", Type: FUNCTION_QUERY,
+		Description: "Reports whether an IMEI is blacklisted as stolen or lost",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEI)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.check_blacklist(stub, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_alerts", Type: FUNCTION_QUERY, Roles: []string{VENDOR},
+		Description: "Returns the alerts raised on a device, or on every device, optionally only OPEN or CLOSED ones",
+		Forms: [][]ArgSpec{{optional("imei", ARG_IMEI), optional("status", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.get_alerts(stub, strings.TrimSpace(optional_arg(args, 0)), optional_arg(args, 1))
+		}})
+
+	register(FunctionSpec{Name: "get_device_template", Type: FUNCTION_QUERY,
+		Description: "Returns a device template",
+		Forms: [][]ArgSpec{{arg("name", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.get_device_template(stub, args[0])
+		}})
+
+	register(FunctionSpec{Name: "decode_imei", Type: FUNCTION_QUERY,
+		Description: "Splits an IMEI into TAC, serial number and software version",
+		Forms: [][]ArgSpec{{arg("imei", ARG_IMEISV)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.decode_imei(stub, args[0])
+		}})
+
+	register(FunctionSpec{Name: "get_lifecycle", Type: FUNCTION_QUERY,
+		Description: "Returns the lifecycle table as JSON or as a DOT graph",
+		Forms: [][]ArgSpec{{optional("format", ARG_STRING)}},
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, args []string) ([]byte, error) {
+			return t.get_lifecycle(stub, optional_arg(args, 0))
+		}})
+
+	register(FunctionSpec{Name: "describe_functions", Type: FUNCTION_QUERY,
+		Description: "Lists the functions of this chaincode with their arguments",
+		run: func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, _ string, _ []string) ([]byte, error) {
+			return describe_functions()
+		}})
+}
+
+//=================================================================================================
+//  lifecycle_spec -- the registry entry of a lifecycle function, taken from its transitions
+//=================================================================================================
+
+func lifecycle_spec(function string) FunctionSpec {
+
+	spec := FunctionSpec{Name: function, Type: FUNCTION_INVOKE}
+
+	candidates := lifecycle_transitions(function)
+
+	form := []ArgSpec{}
+	for _, name := range candidates[0].Args {
+		argType := ARG_STRING
+		if name == "imei" || name == "oldimei" { argType = ARG_IMEI }
+		form = append(form, arg(name, argType))
+	}
+	spec.Forms = [][]ArgSpec{form}
+
+	edges := []string{}
+
+	for _, tr := range candidates {
+		edges = append(edges, tr.From+" -> "+tr.To)
+
+		known := false
+		for _, role := range spec.Roles { known = known || role == tr.Caller }
+		if !known { spec.Roles = append(spec.Roles, tr.Caller) }
+	}
+
+	spec.Description = "Lifecycle transition " + strings.Join(edges, ", ")
+
+	if candidates[0].Customer != "" { spec.Description += "; the customer id is passed in the transient field " + TRANSIENT_CUSTOMER }
+
+	spec.run = func(t *SimpleChainCode, stub shim.ChaincodeStubInterface, callerAffiliation string, args []string) ([]byte, error) {
+		change, err := t.run_transition(stub, callerAffiliation, function, args)
+		if err != nil { return nil, err }
+		return nil, t.emit_lifecycle_event(stub, function, []DeviceChange{change})
+	}
+
+	return spec
+}
+
+//=================================================================================================
+//  lookup_function -- returns the registry entry for a function name
+//=================================================================================================
+
+func lookup_function(function string) (FunctionSpec, error) {
+
+	spec, ok := registry[function]
+
+	if !ok { return spec, new_error(ERR_UNKNOWN_FUNCTION, "Unknown function %s", function) }
+
+	return spec, nil
+}
+
+//=================================================================================================
+//  check_call -- validates the caller and the arguments of a call against its FunctionSpec and
+//  returns the arguments to run it with
+//=================================================================================================
+
+func (spec FunctionSpec) check_call(callerAffiliation string, args []string) ([]string, error) {
+
+	if len(spec.Roles) > 0 {
+		allowed := false
+		for _, role := range spec.Roles { allowed = allowed || role == callerAffiliation }
+		if !allowed { return nil, permission_denied("%s requires %s", spec.Name, strings.Join(spec.Roles, " or ")) }
+	}
+
+	for _, form := range spec.Forms {
+
+		required := 0
+		for _, a := range form {
+			if !a.Optional { required++ }
+		}
+
+		if len(args) < required || len(args) > len(form) { continue }
+
+		checked := []string{}
+		for i, value := range args {
+			err := check_arg(form[i], value)
+			if err != nil { return nil, err }
+			if form[i].Type == ARG_IMEI { value = imei_of(value) }
+			checked = append(checked, value)
+		}
+		return checked, nil
+	}
+
+	return nil, validation_failed("%s expects %s", spec.Name, spec.usage())
+}
+
+func check_arg(a ArgSpec, value string) error {
+
+	if a.Type == ARG_STRING { return nil }
+
+	if strings.TrimSpace(value) == "" {
+		if a.Optional { return nil }
+		return validation_failed("Argument %s must not be empty", a.Name)
+	}
+
+	switch a.Type {
+	case ARG_IMEI, ARG_IMEISV:
+		if strings.ContainsAny(strings.TrimSpace(value), " \t\r\n") { return validation_failed("Argument %s is not an IMEI", a.Name) }
+	case ARG_JSON:
+		if !json.Valid([]byte(value)) { return validation_failed("Argument %s is not valid JSON", a.Name) }
+	case ARG_DATE:
+		if _, err := parse_ledger_time(value); err != nil { return validation_failed("Argument %s is not a date: %s", a.Name, value) }
+	}
+	return nil
+}
+
+// usage renders the argument forms of a function, e.g. "(imei [template])"
+func (spec FunctionSpec) usage() string {
+
+	forms := []string{}
+
+	for _, form := range spec.Forms {
+		names := []string{}
+		for _, a := range form {
+			if a.Optional {
+				names = append(names, "["+a.Name+"]")
+			} else {
+				names = append(names, a.Name)
+			}
+		}
+		forms = append(forms, "("+strings.Join(names, " ")+")")
+	}
+	return strings.Join(forms, " or ")
+}
+
+//=================================================================================================
+//  describe_functions -- lists every registered function in name order
+//=================================================================================================
+
+func describe_functions() ([]byte, error) {
+
+	specs := []FunctionSpec{}
+	for _, spec := range registry { specs = append(specs, spec) }
+
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+
+	return json.Marshal(specs)
+}
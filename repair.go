@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const REPAIR_KEY = "repair"
+
+const (
+	REPAIR_IN_PROGRESS = "IN_PROGRESS"
+	REPAIR_REFURBISHED = "REFURBISHED"
+	REPAIR_SCRAPPED    = "SCRAPPED"
+)
+
+// The grades refurbished stock is sold in, best first
+var refurbished_grades = []string{"A", "B", "C"}
+
+//=================================================================================================
+//  RepairRecord -- what the vendor's repair centre did with a returned device. It is opened by
+//  START_REPAIR, identified by that transaction's id, and closed by REFURBISH_DEV with the parts
+//  replaced and the grade given, or by SCRAP_DEV.
+//=================================================================================================
+
+type RepairRecord struct {
+	ID            string     `json:"id"`
+	IMEI          string     `json:"imei"`
+	Technician    string     `json:"technician"`
+	Fault         string     `json:"fault"`
+	PartsReplaced []string   `json:"partsreplaced"`
+	Grade         string     `json:"grade,omitempty"`
+	Outcome       string     `json:"outcome"`
+	Notes         string     `json:"notes,omitempty"`
+	StartedAt     LedgerTime `json:"startedat"`
+	FinishedAt    LedgerTime `json:"finishedat"`
+}
+
+// RepairSummary -- the redacted view of a RepairRecord
+type RepairSummary struct {
+	ID       string `json:"id"`
+	IMEI     string `json:"imei"`
+	Outcome  string `json:"outcome"`
+	Redacted bool   `json:"redacted"`
+}
+
+func repair_key(stub shim.ChaincodeStubInterface, imei string, id string) (string, error) {
+	return create_composite_key(stub, REPAIR_KEY, imei, id)
+}
+
+func (t *SimpleChainCode) save_repair(stub shim.ChaincodeStubInterface, r RepairRecord) error {
+
+	bytes, err := json.Marshal(r)
+
+	if err != nil { return errors.New("Error converting repair record") }
+
+	key, err := repair_key(stub, r.IMEI, r.ID)
+
+	if err != nil { return err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("SAVE_REPAIR: Error storing repair %s: %s", r.ID, err); return errors.New("Error storing repair record") }
+
+	return nil
+}
+
+//=================================================================================================
+//  repair_transition -- runs START_REPAIR, REFURBISH_DEV or SCRAP_DEV and keeps the device's
+//  repair record in step with it
+//=================================================================================================
+
+func (t *SimpleChainCode) repair_transition(stub shim.ChaincodeStubInterface, callerAffiliation string, function string, args []string) ([]byte, error) {
+
+	var parts []string
+
+	if function == "START_REPAIR" {
+		if strings.TrimSpace(args[1]) == "" || strings.TrimSpace(args[2]) == "" { return nil, validation_failed("A repair needs a technician and a fault") }
+	} else if function == "REFURBISH_DEV" {
+		args[1] = strings.ToUpper(strings.TrimSpace(args[1]))
+		known := false
+		for _, g := range refurbished_grades { known = known || g == args[1] }
+		if !known { return nil, validation_failed("Unknown grade %s, expected one of %s", args[1], strings.Join(refurbished_grades, ", ")) }
+		if json.Unmarshal([]byte(args[2]), &parts) != nil { return nil, validation_failed("Expected a JSON array of the parts replaced") }
+	}
+
+	dev, err := t.get_device(stub, args[0])
+
+	if err != nil { return nil, err }
+
+	change, err := t.run_transition(stub, callerAffiliation, function, args)
+
+	if err != nil { return nil, err }
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	var r RepairRecord
+
+	if function == "START_REPAIR" {
+		r = RepairRecord{ID: stub.GetTxID(), IMEI: dev.IMEI, Technician: strings.TrimSpace(args[1]), Fault: args[2],
+			PartsReplaced: []string{}, Outcome: REPAIR_IN_PROGRESS, StartedAt: now}
+	} else {
+		key, err := repair_key(stub, dev.IMEI, dev.Repair)
+		if err != nil { return nil, err }
+		bytes, err := stub.GetState(key)
+		if err != nil || bytes == nil { return nil, errors.New("Unable to get repair record " + dev.Repair) }
+		err = json.Unmarshal(bytes, &r)
+		if err != nil { return nil, errors.New("Corrupt repair record " + dev.Repair) }
+
+		r.FinishedAt = now
+		if function == "REFURBISH_DEV" {
+			r.Outcome, r.Grade, r.PartsReplaced = REPAIR_REFURBISHED, args[1], parts
+		} else {
+			r.Outcome, r.Notes = REPAIR_SCRAPPED, args[1]
+		}
+	}
+
+	err = t.save_repair(stub, r)
+
+	if err != nil { return nil, err }
+
+	err = t.emit_lifecycle_event(stub, function, []DeviceChange{change})
+
+	if err != nil { return nil, err }
+
+	return json.Marshal(r)
+}
+
+//=================================================================================================
+//  get_repairs -- lists the repair records of a device, as their RepairSummary to a reader given
+//  the summary of the device
+//=================================================================================================
+
+func (t *SimpleChainCode) get_repairs(stub shim.ChaincodeStubInterface, r Reader, imei string) ([]byte, error) {
+
+	dev, view, err := t.read_device(stub, r, imei)
+
+	if err != nil { return nil, err }
+
+	repairs := []RepairRecord{}
+
+	err = t.for_each_partial_key(stub, REPAIR_KEY, []string{dev.IMEI}, func(key string, value []byte) (bool, error) {
+
+		var r RepairRecord
+
+		err := json.Unmarshal(value, &r)
+
+		if err != nil { return false, errors.New("Corrupt repair record " + key) }
+
+		repairs = append(repairs, r)
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	if view == VIEW_FULL { return json.Marshal(repairs) }
+
+	summaries := []RepairSummary{}
+
+	for _, rec := range repairs { summaries = append(summaries, RepairSummary{ID: rec.ID, IMEI: rec.IMEI, Outcome: rec.Outcome, Redacted: true}) }
+
+	return json.Marshal(summaries)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  Private data collections, defined in collections_config.json. SALES_COLLECTION is shared by
+//  the vendor and the stores and holds who bought a device, who sold it and what they paid. Every
+//  store keeps what a device cost it in a collection of its own, MARGINS_COLLECTION followed by
+//  its MSP id, so no other store or the vendor can read it. A store joining the network gets its
+//  collection by adding an entry named storeMargins_<MSP id>, with the policy OR('<MSP id>.member'),
+//  to collections_config.json and approving the chaincode definition with the new file; until
+//  then its sales with a cost price are refused. Peers outside a collection only see the hash of
+//  its entries, and a device only carries the SaleHash of its sale.
+//=================================================================================================
+
+const (
+	SALES_COLLECTION   = "deviceSales"
+	MARGINS_COLLECTION = "storeMargins"
+)
+
+const (
+	SALE_KEY   = "sale"
+	MARGIN_KEY = "margin"
+)
+
+// TRANSIENT_SALE is the transient field a store passes the SaleDetails of a sale in, so that
+// they are not written to the transaction
+const TRANSIENT_SALE = "sale"
+
+//=================================================================================================
+//  SaleDetails -- what the store knows about a sale beyond the IMEI it passes to TRF_TO_CUST: the
+//  customer id and the seller are required. Amounts are in the store's currency with at most two
+//  decimals; without a CostPrice no margin is recorded.
+//=================================================================================================
+
+type SaleDetails struct {
+	Customer        string `json:"customer"`
+	Seller          string `json:"seller"`
+	CustomerName    string `json:"customername"`
+	CustomerContact string `json:"customercontact"`
+	SalePrice       string `json:"saleprice"`
+	CostPrice       string `json:"costprice"`
+	Currency        string `json:"currency"`
+}
+
+//=================================================================================================
+//  SaleRecord -- the private part of a sale, identified by the transaction id and stored in
+//  SALES_COLLECTION. Customer is the customer id the device's OwnerID is the customer_hash of.
+//=================================================================================================
+
+type SaleRecord struct {
+	ID              string     `json:"id"`
+	IMEI            string     `json:"imei"`
+	Store           string     `json:"store"`
+	SoldBy          string     `json:"soldby"`
+	Customer        string     `json:"customer"`
+	CustomerName    string     `json:"customername,omitempty"`
+	CustomerContact string     `json:"customercontact,omitempty"`
+	SalePrice       string     `json:"saleprice,omitempty"`
+	Currency        string     `json:"currency,omitempty"`
+	SoldAt          LedgerTime `json:"soldat"`
+}
+
+// StoreMargin -- what the store paid for a device it sold and what it made on it, kept in
+// MARGINS_COLLECTION under the id of the sale
+type StoreMargin struct {
+	ID        string `json:"id"`
+	IMEI      string `json:"imei"`
+	Store     string `json:"store"`
+	CostPrice string `json:"costprice"`
+	SalePrice string `json:"saleprice"`
+	Margin    string `json:"margin"`
+	Currency  string `json:"currency,omitempty"`
+}
+
+func sale_key(stub shim.ChaincodeStubInterface, imei string, id string) (string, error) {
+	return create_composite_key(stub, SALE_KEY, imei, id)
+}
+
+func margin_key(stub shim.ChaincodeStubInterface, imei string, id string) (string, error) {
+	return create_composite_key(stub, MARGIN_KEY, imei, id)
+}
+
+// margins_collection -- the collection of the margins of the store with MSP id store
+func margins_collection(store string) string {
+	return MARGINS_COLLECTION + "_" + store
+}
+
+// sale_hash -- the hash a device keeps of its stored SaleRecord
+func sale_hash(bytes []byte) string {
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+//=================================================================================================
+//  parse_amount and format_amount -- convert an amount to and from a number of hundredths
+//=================================================================================================
+
+func parse_amount(amount string) (int64, error) {
+
+	if !price_pattern.MatchString(amount) { return 0, validation_failed("Invalid amount %q", amount) }
+
+	whole, fraction := amount, "00"
+
+	if i := strings.Index(amount, "."); i >= 0 { whole, fraction = amount[:i], (amount[i+1:] + "0")[:2] }
+
+	value, err := strconv.ParseInt(whole+fraction, 10, 64)
+
+	if err != nil { return 0, validation_failed("Invalid amount %q", amount) }
+
+	return value, nil
+}
+
+func format_amount(hundredths int64) string {
+
+	sign := ""
+	if hundredths < 0 { sign, hundredths = "-", -hundredths }
+
+	return fmt.Sprintf("%s%d.%02d", sign, hundredths/100, hundredths%100)
+}
+
+//=================================================================================================
+//  get_sale_details -- reads the SaleDetails from the transient map
+//=================================================================================================
+
+func get_sale_details(stub shim.ChaincodeStubInterface) (SaleDetails, error) {
+
+	var s SaleDetails
+
+	transient, err := stub.GetTransient()
+
+	if err != nil { return s, errors.New("Unable to read transient data") }
+
+	bytes, found := transient[TRANSIENT_SALE]
+
+	if !found { return s, validation_failed("A sale needs its details in the transient field %s", TRANSIENT_SALE) }
+
+	decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(&s)
+
+	if err != nil { return s, validation_failed("Invalid sale details: %s", err) }
+
+	s.Customer, s.Seller = strings.TrimSpace(s.Customer), strings.TrimSpace(s.Seller)
+	s.SalePrice, s.CostPrice = strings.TrimSpace(s.SalePrice), strings.TrimSpace(s.CostPrice)
+
+	if s.Customer == "" || s.Seller == "" { return s, validation_failed("Sale details need the customer and the seller") }
+
+	if s.SalePrice != "" {
+		if _, err = parse_amount(s.SalePrice); err != nil { return s, err }
+	}
+
+	if s.CostPrice != "" {
+		if s.SalePrice == "" { return s, validation_failed("Sale details need the sale price to record a margin") }
+		if _, err = parse_amount(s.CostPrice); err != nil { return s, err }
+	}
+
+	return s, nil
+}
+
+//=================================================================================================
+//  sale_transition -- runs TRF_TO_CUST or TRF_TO_CUST_REFURB and stores the private part of the
+//  sale. The device keeps the id of the SaleRecord and its hash; the response and the event carry
+//  nothing private.
+//=================================================================================================
+
+func (t *SimpleChainCode) sale_transition(stub shim.ChaincodeStubInterface, callerAffiliation string, function string, args []string) ([]byte, error) {
+
+	details, err := get_sale_details(stub)
+
+	if err != nil { return nil, err }
+
+	before, err := t.get_device(stub, args[0])
+
+	if err != nil { return nil, err }
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	r := SaleRecord{ID: stub.GetTxID(), IMEI: before.IMEI, Store: before.OwnerID, SoldBy: details.Seller, Customer: details.Customer,
+		CustomerName: strings.TrimSpace(details.CustomerName), CustomerContact: strings.TrimSpace(details.CustomerContact),
+		SalePrice: details.SalePrice, Currency: details.Currency, SoldAt: now}
+
+	bytes, err := json.Marshal(r)
+
+	if err != nil { return nil, errors.New("Error converting sale record") }
+
+	change, err := t.run_transition_setting(stub, callerAffiliation, function, args, map[string]string{"sale": r.ID, "salehash": sale_hash(bytes)})
+
+	if err != nil { return nil, err }
+
+	err = t.put_sale(stub, r, bytes)
+
+	if err != nil { return nil, err }
+
+	if details.CostPrice != "" {
+		err = t.save_margin(stub, r, details.CostPrice)
+		if err != nil { return nil, err }
+	}
+
+	return nil, t.emit_lifecycle_event(stub, function, []DeviceChange{change})
+}
+
+//=================================================================================================
+//  put_sale -- stores the marshalled SaleRecord r in SALES_COLLECTION
+//=================================================================================================
+
+func (t *SimpleChainCode) put_sale(stub shim.ChaincodeStubInterface, r SaleRecord, bytes []byte) error {
+
+	key, err := sale_key(stub, r.IMEI, r.ID)
+
+	if err != nil { return err }
+
+	err = stub.PutPrivateData(SALES_COLLECTION, key, bytes)
+
+	if err != nil { fmt.Printf("PUT_SALE: Error storing sale %s: %s", r.ID, err); return errors.New("Error storing sale record") }
+
+	return nil
+}
+
+func (t *SimpleChainCode) save_margin(stub shim.ChaincodeStubInterface, r SaleRecord, costPrice string) error {
+
+	cost, _ := parse_amount(costPrice)
+	price, _ := parse_amount(r.SalePrice)
+
+	m := StoreMargin{ID: r.ID, IMEI: r.IMEI, Store: r.Store, CostPrice: costPrice, SalePrice: r.SalePrice,
+		Margin: format_amount(price - cost), Currency: r.Currency}
+
+	bytes, err := json.Marshal(m)
+
+	if err != nil { return errors.New("Error converting store margin") }
+
+	key, err := margin_key(stub, m.IMEI, m.ID)
+
+	if err != nil { return err }
+
+	err = stub.PutPrivateData(margins_collection(m.Store), key, bytes)
+
+	if err != nil {
+		fmt.Printf("SAVE_MARGIN: Error storing margin %s: %s", m.ID, err)
+		return validation_failed("Unable to record a margin for %s, the collection %s may not be defined", m.Store, margins_collection(m.Store))
+	}
+
+	return nil
+}
+
+//=================================================================================================
+//  legacy_seller -- the seller a device record stored in the clear before sales were private, ""
+//  if it has none. Device has no such field, so saving the device drops it.
+//=================================================================================================
+
+func legacy_seller(value []byte) string {
+
+	var legacy struct {
+		SoldBy string `json:"soldby"`
+	}
+
+	err := json.Unmarshal(value, &legacy)
+
+	if err != nil || legacy.SoldBy == "UNDEFINED" { return "" }
+
+	return legacy.SoldBy
+}
+
+//=================================================================================================
+//  migrate_sellers -- moves the seller every device recorded in the clear into a private
+//  SaleRecord, see save_legacy_sale. Run it after migrate_imei_index and before any migration
+//  that rewrites devices.
+//=================================================================================================
+
+func (t *SimpleChainCode) migrate_sellers(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	count := 0
+
+	err := t.for_each_partial_key(stub, DEVICE_INDEX, nil, func(key string, value []byte) (bool, error) {
+
+		seller := legacy_seller(value)
+
+		if seller == "" { return true, nil }
+
+		var dev Device
+
+		err := json.Unmarshal(value, &dev)
+
+		if err != nil { fmt.Printf("MIGRATE_SELLERS: unable to read device %s", key); return false, errors.New("Unable to migrate device " + key) }
+
+		if dev.Sale == "" {
+			err = t.save_legacy_sale(stub, &dev, seller)
+			if err != nil { return false, err }
+		}
+
+		_, err = t.save_changes(stub, dev)
+
+		if err != nil { return false, err }
+
+		count++
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	return []byte(fmt.Sprintf("%d", count)), nil
+}
+
+//=================================================================================================
+//  save_legacy_sale -- moves the seller a device recorded before sales were private into a
+//  SaleRecord of SALES_COLLECTION, which the device then refers to. The customer of such a sale
+//  is not known.
+//=================================================================================================
+
+func (t *SimpleChainCode) save_legacy_sale(stub shim.ChaincodeStubInterface, dev *Device, seller string) error {
+
+	r := SaleRecord{ID: stub.GetTxID(), IMEI: dev.IMEI, Store: dev.SellingStore, SoldBy: seller, SoldAt: dev.DateOfSale}
+
+	bytes, err := json.Marshal(r)
+
+	if err != nil { return errors.New("Error converting sale record") }
+
+	err = t.put_sale(stub, r, bytes)
+
+	if err != nil { return err }
+
+	dev.Sale = r.ID
+	dev.SaleHash = sale_hash(bytes)
+
+	return nil
+}
+
+//=================================================================================================
+//  get_sale -- returns the private record of the last sale of a device. Only members of
+//  SALES_COLLECTION whose read policy covers the device can read it; the record is checked
+//  against the hash the device keeps.
+//=================================================================================================
+
+func (t *SimpleChainCode) get_sale(stub shim.ChaincodeStubInterface, r Reader, imei string) ([]byte, error) {
+
+	dev, view, err := t.read_device(stub, r, imei)
+
+	if err != nil { return nil, err }
+
+	if view != VIEW_FULL { return nil, permission_denied("The sale of device %s is not visible to %s", imei, r.Party) }
+
+	if dev.Sale == "" { return nil, not_found("Device %s has no recorded sale", imei) }
+
+	key, err := sale_key(stub, dev.IMEI, dev.Sale)
+
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetPrivateData(SALES_COLLECTION, key)
+
+	if err != nil { fmt.Printf("GET_SALE: Error reading sale %s: %s", dev.Sale, err); return nil, permission_denied("Sale records are private to %s", SALES_COLLECTION) }
+
+	if bytes == nil { return nil, not_found("Sale %s of device %s is not held by this peer", dev.Sale, imei) }
+
+	if sale_hash(bytes) != dev.SaleHash { return nil, new_error(ERR_INTERNAL, "Sale %s of device %s does not match its hash", dev.Sale, imei) }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  get_store_margin -- returns what the store made on the last sale of a device, to that store
+//=================================================================================================
+
+func (t *SimpleChainCode) get_store_margin(stub shim.ChaincodeStubInterface, imei string) ([]byte, error) {
+
+	party, err := t.get_party(stub)
+
+	if err != nil { return nil, err }
+
+	dev, err := t.get_device(stub, imei)
+
+	if err != nil { return nil, err }
+
+	if dev.Sale == "" { return nil, not_found("Device %s has no recorded sale", imei) }
+
+	key, err := margin_key(stub, dev.IMEI, dev.Sale)
+
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetPrivateData(margins_collection(party), key)
+
+	if err != nil { fmt.Printf("GET_STORE_MARGIN: Error reading margin %s: %s", dev.Sale, err); return nil, permission_denied("Store margins are private to %s", margins_collection(party)) }
+
+	if bytes == nil { return nil, not_found("No margin was recorded by %s for the sale of device %s", party, imei) }
+
+	return bytes, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPrivateSale(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei, other := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:4], imei)
+	l.run_steps(to_vendor_and_back[:4], other)
+
+	// the customer and the seller are only taken from the sale details
+	l.as(STORE).fails(ERR_VALIDATION_FAILED, "TRF_TO_CUST", imei, STORE, "cust-42")
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "TRF_TO_CUST", imei)
+	l.selling("", "cust-42").fails(ERR_VALIDATION_FAILED, "TRF_TO_CUST", imei)
+
+	for _, details := range []string{
+		`{"customer":"cust-42","seller":"STORE","saleprice":"12.345"}`,
+		`{"customer":"cust-42","seller":"STORE","costprice":"300"}`,
+	} {
+		l.stub.TransientMap = map[string][]byte{TRANSIENT_SALE: []byte(details)}
+		l.fails(ERR_VALIDATION_FAILED, "TRF_TO_CUST", imei)
+	}
+
+	l.stub.TransientMap = map[string][]byte{TRANSIENT_SALE: []byte(`{"customer":"cust-42","seller":"clerk-7","customername":"Ada Lovelace",` +
+		`"customercontact":"ada@example.com","saleprice":"349.99","costprice":"300","currency":"EUR"}`)}
+	l.must("TRF_TO_CUST", imei)
+
+	// nothing private in the public record or the event
+	public := l.must("get_device_details", imei)
+	for _, private := range []string{"Ada", "349.99", "cust-42", "clerk-7"} {
+		if strings.Contains(public, private) { t.Errorf("%s in the device record %s", private, public) }
+		if strings.Contains(string(l.events[len(l.events)-1].Payload), private) { t.Errorf("%s in the event", private) }
+	}
+
+	var sale SaleRecord
+	if err := json.Unmarshal([]byte(l.as(VENDOR).must("get_sale", imei)), &sale); err != nil { t.Fatal(err) }
+	if sale.Customer != "cust-42" || sale.SoldBy != "clerk-7" || sale.CustomerName != "Ada Lovelace" || sale.SalePrice != "349.99" || sale.Store != STORE {
+		t.Errorf("sale %+v", sale)
+	}
+	if d := l.device(imei); d.Sale != sale.ID || d.SaleHash == "" { t.Errorf("device %+v", d) }
+
+	var m StoreMargin
+	if err := json.Unmarshal([]byte(l.as(STORE).must("get_store_margin", imei)), &m); err != nil { t.Fatal(err) }
+	if m.Margin != "49.99" || m.Currency != "EUR" { t.Errorf("margin %+v", m) }
+
+	// the margin is kept in the selling store's own collection
+	key, _ := margin_key(l.stub, imei, sale.ID)
+	if l.stub.PvtState[margins_collection(STORE)][key] == nil { t.Errorf("margin not in %s", margins_collection(STORE)) }
+	l.as_party(STORE, "STORE2").fails(ERR_NOT_FOUND, "get_store_margin", imei)
+
+	l.as(WAREHOUSE).fails(ERR_PERMISSION_DENIED, "get_sale", imei)
+	l.as(VENDOR).fails(ERR_PERMISSION_DENIED, "get_store_margin", imei)
+
+	// a sale without prices records the customer and the seller only
+	l.as(STORE).selling(STORE, "cust-7").must("TRF_TO_CUST", other)
+	l.fails(ERR_NOT_FOUND, "get_store_margin", other)
+	l.fails(ERR_NOT_FOUND, "get_sale", l.create(3))
+
+	// the devices a store sold
+	if sold := l.as(VENDOR).visible(`{"sellingstore":"STORE"}`); len(sold) != 2 { t.Errorf("sold by STORE %v", sold) }
+	if sold := l.visible(`{"sellingstore":"STORE2"}`); len(sold) != 0 { t.Errorf("sold by STORE2 %v", sold) }
+
+	// a record that no longer matches the device's hash is not returned
+	key, _ = sale_key(l.stub, imei, sale.ID)
+	l.stub.PvtState[SALES_COLLECTION][key] = []byte(`{"id":"` + sale.ID + `","saleprice":"1"}`)
+	l.as(STORE).fails(ERR_INTERNAL, "get_sale", imei)
+}
+
+func TestMigrateSellers(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	// a device the original chaincode sold, with the seller in the clear
+	sold := test_imei(3)
+	legacy := `{"devicename":"LENOVO","devicemodel":"VIBE","dateofmanf":"2016-12-03 00:00:00 +0000 UTC","consignmentnumber":"C1",` +
+		`"dateofdelivery":"UNDEFINED","dateofreceipt":"UNDEFINED","dateofsale":"2017-01-05 10:00:00 +0000 UTC","oldimei":"UNDEFINED",` +
+		`"imei":"` + sold + `","status":"DELIVERED_TO_CUSTOMER","soldby":"clerk-3","owner":"CUSTOMER"}`
+
+	key, _ := device_key(l.stub, sold)
+	l.begin()
+	l.stub.PutState(key, []byte(legacy))
+	l.end()
+
+	// the other migrations would drop the seller
+	l.as(VENDOR).fails(ERR_VALIDATION_FAILED, "migrate_dates")
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "migrate_sellers")
+
+	if out := l.as(VENDOR).must("migrate_sellers"); out != "1" { t.Errorf("migrated %s devices", out) }
+	if strings.Contains(string(l.stub.State[key]), "clerk-3") { t.Errorf("seller left public: %s", l.stub.State[key]) }
+
+	var sale SaleRecord
+	if err := json.Unmarshal([]byte(l.must("get_sale", sold)), &sale); err != nil || sale.SoldBy != "clerk-3" || sale.SoldAt.Year() != 2017 { t.Errorf("sale %+v", sale) }
+
+	if out := l.must("migrate_sellers"); out != "0" { t.Errorf("migrated %s devices again", out) }
+	l.must("migrate_dates")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  DeviceTemplate -- default name, model and date of manufacture used by create_device_from_template
+//  so a vendor can register a production run by IMEI alone. An empty DateOfManf means the date of
+//  the registering transaction.
+//=================================================================================================
+
+type DeviceTemplate struct {
+	Name        string `json:"name"`
+	DeviceName  string `json:"devicename"`
+	DeviceModel string `json:"devicemodel"`
+	DateOfManf  string `json:"dateofmanf"`
+}
+
+const DEFAULT_TEMPLATE = "default"
+
+// the values the single argument create_device has always used
+var default_template = DeviceTemplate{Name: DEFAULT_TEMPLATE, DeviceName: "LENOVO", DeviceModel: "VIBE", DateOfManf: "2016-12-03"}
+
+const TEMPLATE_INDEX = "template~name"
+
+func template_key(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	return create_composite_key(stub, TEMPLATE_INDEX, name)
+}
+
+//=================================================================================================
+//  set_device_template -- validates and stores a template, replacing any with the same name
+//=================================================================================================
+
+func (t *SimpleChainCode) set_device_template(stub shim.ChaincodeStubInterface, tmpl DeviceTemplate) ([]byte, error) {
+
+	tmpl.Name = strings.TrimSpace(tmpl.Name)
+
+	if tmpl.Name == "" { return nil, validation_failed("Template name is required") }
+	if strings.TrimSpace(tmpl.DeviceName) == "" { return nil, validation_failed("Device name is required") }
+	if strings.TrimSpace(tmpl.DeviceModel) == "" { return nil, validation_failed("Device model is required") }
+
+	if tmpl.DateOfManf != "" {
+		if _, err := parse_ledger_time(tmpl.DateOfManf); err != nil { return nil, validation_failed("Invalid date of manufacture %s", tmpl.DateOfManf) }
+	}
+
+	bytes, err := json.Marshal(tmpl)
+
+	if err != nil { return nil, errors.New("Error converting device template") }
+
+	key, err := template_key(stub, tmpl.Name)
+
+	if err != nil { return nil, err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("SET_DEVICE_TEMPLATE: Error storing template: %s", err); return nil, errors.New("Error storing device template") }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  get_template -- retrieves a template. The default template is always available, even on ledgers
+//  initialised before templates existed.
+//=================================================================================================
+
+func (t *SimpleChainCode) get_template(stub shim.ChaincodeStubInterface, name string) (DeviceTemplate, error) {
+
+	var tmpl DeviceTemplate
+
+	key, err := template_key(stub, name)
+
+	if err != nil { return tmpl, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return tmpl, errors.New("Unable to get device template " + name) }
+
+	if bytes == nil {
+		if name == DEFAULT_TEMPLATE { return default_template, nil }
+		return tmpl, not_found("Unknown device template %s", name)
+	}
+
+	err = json.Unmarshal(bytes, &tmpl)
+
+	if err != nil { return tmpl, errors.New("Corrupt device template " + name) }
+
+	return tmpl, nil
+}
+
+func (t *SimpleChainCode) get_device_template(stub shim.ChaincodeStubInterface, name string) ([]byte, error) {
+
+	tmpl, err := t.get_template(stub, name)
+
+	if err != nil { return nil, err }
+
+	return json.Marshal(tmpl)
+}
+
+//=================================================================================================
+//  createDeviceFromTemplate -- creates a device with the given IMEI from a stored template
+//=================================================================================================
+
+func (t *SimpleChainCode) createDeviceFromTemplate(stub shim.ChaincodeStubInterface, imeiId string, name string) ([]byte, error) {
+
+	tmpl, err := t.get_template(stub, name)
+
+	if err != nil { return nil, err }
+
+	manf := tmpl.DateOfManf
+
+	if manf == "" {
+		now, err := t.tx_time(stub)
+		if err != nil { return nil, err }
+		manf = now.String()
+	}
+
+	return t.register_device(stub, DeviceSpec{IMEI: imeiId, DeviceName: tmpl.DeviceName, DeviceModel: tmpl.DeviceModel, DateOfManf: manf})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+//=================================================================================================
+//  LedgerTime -- a date stored on the ledger. It is written as RFC 3339 in UTC, or "" when unset,
+//  and reads the formats used by earlier versions of the chaincode so old records stay readable.
+//=================================================================================================
+
+type LedgerTime struct {
+	time.Time
+}
+
+var legacy_time_layouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST", // time.Time.String()
+	"2006-01-02",
+	"02-01-2006", // dateofmanf as entered on the creation form
+}
+
+func parse_ledger_time(value string) (LedgerTime, error) {
+
+	value = strings.Trim(strings.TrimSpace(value), "'")
+
+	if value == "" || value == "UNDEFINED" { return LedgerTime{}, nil }
+
+	// time.Time.String() appends the monotonic clock reading, which is not part of the date
+	if i := strings.Index(value, " m="); i >= 0 { value = value[:i] }
+
+	if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil { return LedgerTime{parsed.UTC()}, nil }
+
+	for _, layout := range legacy_time_layouts {
+		if parsed, err := time.Parse(layout, value); err == nil { return LedgerTime{parsed.UTC()}, nil }
+	}
+
+	return LedgerTime{}, errors.New("Unrecognised date " + value)
+}
+
+func (lt LedgerTime) String() string {
+	if lt.IsZero() { return "" }
+	return lt.UTC().Format(time.RFC3339)
+}
+
+func (lt LedgerTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(lt.String())
+}
+
+func (lt *LedgerTime) UnmarshalJSON(data []byte) error {
+
+	var value string
+
+	err := json.Unmarshal(data, &value)
+
+	if err != nil { return errors.New("Date must be a string") }
+
+	*lt, err = parse_ledger_time(value)
+
+	return err
+}
+
+//=================================================================================================
+//  tx_time -- the proposal timestamp of the current transaction. Every endorsing peer sees the
+//  same value, unlike the local clock, so it is the only time transitions may record.
+//=================================================================================================
+
+func (t *SimpleChainCode) tx_time(stub shim.ChaincodeStubInterface) (LedgerTime, error) {
+
+	ts, err := stub.GetTxTimestamp()
+
+	if err != nil || ts == nil { return LedgerTime{}, errors.New("Unable to get transaction timestamp") }
+
+	return LedgerTime{time.Unix(ts.Seconds, int64(ts.Nanos)).UTC()}, nil
+}
+
+//=================================================================================================
+//  migrate_dates -- rewrites every device and custody record so that its dates are stored in
+//  RFC 3339. Records are parsed with the legacy layouts on read, so running it again is harmless.
+//  Run migrate_imei_index first on ledgers that still hold the IMEI_Holder record, and
+//  migrate_sellers on those whose devices still record their seller.
+//=================================================================================================
+
+func (t *SimpleChainCode) migrate_dates(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	count := 0
+
+	err := t.for_each_partial_key(stub, DEVICE_INDEX, nil, func(key string, value []byte) (bool, error) {
+
+		var dev Device
+
+		err := json.Unmarshal(value, &dev)
+
+		if err != nil { fmt.Printf("MIGRATE_DATES: unable to read device %s", key); return false, errors.New("Unable to migrate device " + key) }
+
+		if legacy_seller(value) != "" { return false, validation_failed("Device %s still records its seller, run migrate_sellers first", dev.IMEI) }
+
+		_, err = t.save_changes(stub, dev)
+
+		if err != nil { return false, err }
+
+		count++
+
+		err = t.for_each_event(stub, dev.IMEI, func(key string, event CustodyEvent) error {
+			bytes, err := json.Marshal(event)
+			if err != nil { return errors.New("Error converting history record") }
+			return stub.PutState(key, bytes)
+		})
+
+		if err != nil { fmt.Printf("MIGRATE_DATES: unable to rewrite history of %s: %s", dev.IMEI, err); return false, errors.New("Error storing history record") }
+
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	return []byte(fmt.Sprintf("%d", count)), nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const (
+	WARRANTY_POLICY_KEY = "warranty_policy"
+	WARRANTY_CLAIM_KEY  = "warranty_claim"
+)
+
+// Models without a policy of their own are covered for this many months from the sale
+const DEFAULT_WARRANTY_MONTHS = 12
+
+const (
+	CLAIM_OPEN     = "OPEN"
+	CLAIM_APPROVED = "APPROVED"
+	CLAIM_REJECTED = "REJECTED"
+	CLAIM_REPAIRED = "REPAIRED"
+	CLAIM_REPLACED = "REPLACED"
+)
+
+// The fault codes a claim can be filed with, and whether the warranty covers them
+var fault_codes = map[string]bool{
+	"DISPLAY":         true,
+	"BATTERY":         true,
+	"CHARGING":        true,
+	"AUDIO":           true,
+	"CAMERA":          true,
+	"CONNECTIVITY":    true,
+	"BUTTONS":         true,
+	"SOFTWARE":        true,
+	"PHYSICAL_DAMAGE": false,
+	"LIQUID_DAMAGE":   false,
+}
+
+// The claim statuses update_warranty_claim can move a claim to from each status. A claim becomes
+// REPLACED only when EXCHANGE_DEV hands the customer a replacement.
+var claim_updates = map[string][]string{
+	CLAIM_OPEN:     {CLAIM_APPROVED, CLAIM_REJECTED},
+	CLAIM_APPROVED: {CLAIM_REPAIRED},
+}
+
+//=================================================================================================
+//  WarrantyPolicy -- the warranty term of a device model, counted from the date of sale
+//=================================================================================================
+
+type WarrantyPolicy struct {
+	DeviceModel string `json:"devicemodel"`
+	Months      int    `json:"months"`
+}
+
+func warranty_policy_key(stub shim.ChaincodeStubInterface, model string) (string, error) {
+	return create_composite_key(stub, WARRANTY_POLICY_KEY, model)
+}
+
+func (p WarrantyPolicy) expiry(sold LedgerTime) LedgerTime {
+	return LedgerTime{sold.AddDate(0, p.Months, 0)}
+}
+
+//=================================================================================================
+//  WarrantyClaim -- a fault reported by the customer a device was sold to. The store files it
+//  while the customer still holds the device; the vendor approves or rejects it. An approved
+//  claim is settled by a repair, recorded with update_warranty_claim, or by a replacement: the
+//  store takes the device back with RTN_FROM_CUST and hands out another with EXCHANGE_DEV.
+//  Device.Claim holds the id of the claim that is not settled yet.
+//=================================================================================================
+
+type WarrantyClaim struct {
+	ID          string        `json:"id"`
+	IMEI        string        `json:"imei"`
+	Customer    string        `json:"customer"`
+	FaultCodes  []string      `json:"faultcodes"`
+	Description string        `json:"description"`
+	Status      string        `json:"status"`
+	FiledBy     string        `json:"filedby"`
+	FiledAt     LedgerTime    `json:"filedat"`
+	Replacement string        `json:"replacement,omitempty"`
+	Updates     []ClaimUpdate `json:"updates"`
+}
+
+type ClaimUpdate struct {
+	Status string     `json:"status"`
+	Note   string     `json:"note"`
+	By     string     `json:"by"`
+	At     LedgerTime `json:"at"`
+}
+
+// WarrantyStatus -- the answer of check_warranty for one device on one date
+type WarrantyStatus struct {
+	IMEI          string     `json:"imei"`
+	Date          LedgerTime `json:"date"`
+	UnderWarranty bool       `json:"underwarranty"`
+	Starts        LedgerTime `json:"starts"`
+	Expires       LedgerTime `json:"expires"`
+	Claim         string     `json:"claim,omitempty"`
+}
+
+// WarrantySummary -- the redacted answer of check_warranty, without the dates of the sale or the
+// open claim
+type WarrantySummary struct {
+	IMEI          string     `json:"imei"`
+	Date          LedgerTime `json:"date"`
+	UnderWarranty bool       `json:"underwarranty"`
+	Redacted      bool       `json:"redacted"`
+}
+
+// ClaimSummary -- the redacted view of a WarrantyClaim
+type ClaimSummary struct {
+	ID       string `json:"id"`
+	IMEI     string `json:"imei"`
+	Status   string `json:"status"`
+	Redacted bool   `json:"redacted"`
+}
+
+func warranty_claim_key(stub shim.ChaincodeStubInterface, imei string, id string) (string, error) {
+	return create_composite_key(stub, WARRANTY_CLAIM_KEY, imei, id)
+}
+
+//=================================================================================================
+//  set_warranty_policy -- stores the warranty term of a model. Devices already sold keep the
+//  expiry they were sold with.
+//=================================================================================================
+
+func (t *SimpleChainCode) set_warranty_policy(stub shim.ChaincodeStubInterface, model string, months string) ([]byte, error) {
+
+	p := WarrantyPolicy{DeviceModel: strings.TrimSpace(model)}
+
+	if p.DeviceModel == "" { return nil, validation_failed("A device model is required") }
+
+	n, err := strconv.Atoi(strings.TrimSpace(months))
+
+	if err != nil || n < 1 || n > 120 { return nil, validation_failed("Warranty term must be between 1 and 120 months, got %s", months) }
+
+	p.Months = n
+
+	bytes, err := json.Marshal(p)
+
+	if err != nil { return nil, errors.New("Error converting warranty policy") }
+
+	key, err := warranty_policy_key(stub, p.DeviceModel)
+
+	if err != nil { return nil, err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("SET_WARRANTY_POLICY: Error storing policy for %s: %s", p.DeviceModel, err); return nil, errors.New("Error storing warranty policy") }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  get_warranty_policy -- the policy of a model, or the default term if it has none
+//=================================================================================================
+
+func (t *SimpleChainCode) get_warranty_policy(stub shim.ChaincodeStubInterface, model string) (WarrantyPolicy, error) {
+
+	p := WarrantyPolicy{DeviceModel: model, Months: DEFAULT_WARRANTY_MONTHS}
+
+	key, err := warranty_policy_key(stub, model)
+
+	if err != nil { return p, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return p, errors.New("Unable to get warranty policy for " + model) }
+
+	if bytes == nil { return p, nil }
+
+	err = json.Unmarshal(bytes, &p)
+
+	if err != nil { return p, errors.New("Corrupt warranty policy for " + model) }
+
+	return p, nil
+}
+
+//=================================================================================================
+//  warranty_expiry -- when the warranty of a sold device ends. Devices sold before expiries were
+//  recorded get the term of their model's policy.
+//=================================================================================================
+
+func (t *SimpleChainCode) warranty_expiry(stub shim.ChaincodeStubInterface, dev Device) (LedgerTime, error) {
+
+	if !dev.WarrantyExpires.IsZero() || dev.DateOfSale.IsZero() { return dev.WarrantyExpires, nil }
+
+	p, err := t.get_warranty_policy(stub, dev.DeviceModel)
+
+	if err != nil { return LedgerTime{}, err }
+
+	return p.expiry(dev.DateOfSale), nil
+}
+
+//=================================================================================================
+//  warranty_status -- whether the device is under warranty on date
+//=================================================================================================
+
+func (t *SimpleChainCode) warranty_status(stub shim.ChaincodeStubInterface, dev Device, date LedgerTime) (WarrantyStatus, error) {
+
+	s := WarrantyStatus{IMEI: dev.IMEI, Date: date, Starts: dev.DateOfSale, Claim: dev.Claim}
+
+	expires, err := t.warranty_expiry(stub, dev)
+
+	if err != nil { return s, err }
+
+	s.Expires = expires
+	s.UnderWarranty = !dev.DateOfSale.IsZero() && !date.Before(dev.DateOfSale.Time) && !date.After(expires.Time)
+
+	return s, nil
+}
+
+//=================================================================================================
+//  check_warranty -- answers whether a device is under warranty on a date, by default the
+//  transaction's; a reader given the summary of the device only learns the answer
+//=================================================================================================
+
+func (t *SimpleChainCode) check_warranty(stub shim.ChaincodeStubInterface, r Reader, imei string, date string) ([]byte, error) {
+
+	dev, view, err := t.read_device(stub, r, imei)
+
+	if err != nil { return nil, err }
+
+	on, err := parse_ledger_time(date)
+
+	if err != nil { return nil, validation_failed("Invalid date %s", date) }
+
+	if on.IsZero() {
+		on, err = t.tx_time(stub)
+		if err != nil { return nil, err }
+	}
+
+	s, err := t.warranty_status(stub, dev, on)
+
+	if err != nil { return nil, err }
+
+	if view != VIEW_FULL { return json.Marshal(WarrantySummary{IMEI: s.IMEI, Date: s.Date, UnderWarranty: s.UnderWarranty, Redacted: true}) }
+
+	return json.Marshal(s)
+}
+
+//=================================================================================================
+//  parse_fault_codes -- decodes the JSON array of fault codes of a claim
+//=================================================================================================
+
+func parse_fault_codes(value string) ([]string, error) {
+
+	var codes []string
+
+	if json.Unmarshal([]byte(value), &codes) != nil || len(codes) == 0 { return nil, validation_failed("Expected a JSON array of fault codes") }
+
+	for i, code := range codes {
+		codes[i] = strings.ToUpper(strings.TrimSpace(code))
+		if _, known := fault_codes[codes[i]]; !known { return nil, validation_failed("Unknown fault code %s", code) }
+	}
+
+	return codes, nil
+}
+
+//=================================================================================================
+//  get_warranty_claim / save_warranty_claim -- read and store a claim
+//=================================================================================================
+
+func (t *SimpleChainCode) get_warranty_claim(stub shim.ChaincodeStubInterface, imei string, id string) (WarrantyClaim, error) {
+
+	var c WarrantyClaim
+
+	key, err := warranty_claim_key(stub, imei, id)
+
+	if err != nil { return c, err }
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil { return c, errors.New("Unable to get warranty claim " + id) }
+
+	if bytes == nil { return c, not_found("Unknown warranty claim %s on device %s", id, imei) }
+
+	err = json.Unmarshal(bytes, &c)
+
+	if err != nil { return c, errors.New("Corrupt warranty claim " + id) }
+
+	return c, nil
+}
+
+func (t *SimpleChainCode) save_warranty_claim(stub shim.ChaincodeStubInterface, c WarrantyClaim) ([]byte, error) {
+
+	bytes, err := json.Marshal(c)
+
+	if err != nil { return nil, errors.New("Error converting warranty claim") }
+
+	key, err := warranty_claim_key(stub, c.IMEI, c.ID)
+
+	if err != nil { return nil, err }
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil { fmt.Printf("SAVE_WARRANTY_CLAIM: Error storing claim %s: %s", c.ID, err); return nil, errors.New("Error storing warranty claim") }
+
+	return bytes, nil
+}
+
+//=================================================================================================
+//  file_warranty_claim -- opens a claim on a device under warranty for the customer it was sold
+//  to, identified by the transaction id
+//=================================================================================================
+
+func (t *SimpleChainCode) file_warranty_claim(stub shim.ChaincodeStubInterface, callerAffiliation string, imei string, customer string, faults string, description string) ([]byte, error) {
+
+	dev, err := t.get_device(stub, imei)
+
+	if err != nil { return nil, err }
+
+	if dev.Owner != CUSTOMER { return nil, validation_failed("Device %s is not with a customer", imei) }
+
+	owned, err := t.is_customer(stub, dev.IMEI, dev.OwnerID, customer)
+
+	if err != nil { return nil, err }
+
+	if !owned { return nil, permission_denied("Device %s does not belong to the customer named in the claim", imei) }
+
+	if dev.Blacklisted != "" { return nil, blacklisted(dev) }
+
+	if dev.Claim != "" { return nil, new_error(ERR_ALREADY_EXISTS, "Device %s already has warranty claim %s", imei, dev.Claim) }
+
+	codes, err := parse_fault_codes(faults)
+
+	if err != nil { return nil, err }
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	s, err := t.warranty_status(stub, dev, now)
+
+	if err != nil { return nil, err }
+
+	if !s.UnderWarranty { return nil, validation_failed("The warranty of device %s expired on %s", imei, s.Expires) }
+
+	c := WarrantyClaim{ID: stub.GetTxID(), IMEI: dev.IMEI, Customer: dev.OwnerID, FaultCodes: codes, Description: description,
+		Status: CLAIM_OPEN, FiledBy: callerAffiliation, FiledAt: now}
+	c.Updates = []ClaimUpdate{{Status: CLAIM_OPEN, Note: description, By: callerAffiliation, At: now}}
+
+	dev.Claim = c.ID
+
+	_, err = t.save_changes(stub, dev)
+
+	if err != nil { return nil, err }
+
+	return t.save_warranty_claim(stub, c)
+}
+
+//=================================================================================================
+//  update_warranty_claim -- the vendor's decision on a claim, and the repair that settles it
+//=================================================================================================
+
+func (t *SimpleChainCode) update_warranty_claim(stub shim.ChaincodeStubInterface, callerAffiliation string, imei string, id string, status string, note string) ([]byte, error) {
+
+	c, err := t.get_warranty_claim(stub, imei, id)
+
+	if err != nil { return nil, err }
+
+	status = strings.ToUpper(strings.TrimSpace(status))
+
+	allowed := false
+	for _, next := range claim_updates[c.Status] { allowed = allowed || next == status }
+
+	if !allowed { return nil, validation_failed("Warranty claim %s cannot go from %s to %s", id, c.Status, status) }
+
+	if status == CLAIM_APPROVED {
+		for _, code := range c.FaultCodes {
+			if !fault_codes[code] { return nil, validation_failed("Fault %s is not covered by the warranty", code) }
+		}
+	}
+
+	now, err := t.tx_time(stub)
+
+	if err != nil { return nil, err }
+
+	c.Status = status
+	c.Updates = append(c.Updates, ClaimUpdate{Status: status, Note: note, By: callerAffiliation, At: now})
+
+	if status == CLAIM_REJECTED || status == CLAIM_REPAIRED {
+		dev, err := t.get_device(stub, imei)
+		if err != nil { return nil, err }
+		if status == CLAIM_REPAIRED && dev.Owner != CUSTOMER { return nil, validation_failed("Device %s was returned; settle the claim with EXCHANGE_DEV", imei) }
+		dev.Claim = ""
+		_, err = t.save_changes(stub, dev)
+		if err != nil { return nil, err }
+	}
+
+	return t.save_warranty_claim(stub, c)
+}
+
+//=================================================================================================
+//  get_warranty_claims -- lists the claims filed on a device, as their ClaimSummary to a reader
+//  given the summary of the device
+//=================================================================================================
+
+func (t *SimpleChainCode) get_warranty_claims(stub shim.ChaincodeStubInterface, r Reader, imei string) ([]byte, error) {
+
+	dev, view, err := t.read_device(stub, r, imei)
+
+	if err != nil { return nil, err }
+
+	claims := []WarrantyClaim{}
+
+	err = t.for_each_partial_key(stub, WARRANTY_CLAIM_KEY, []string{dev.IMEI}, func(key string, value []byte) (bool, error) {
+
+		var c WarrantyClaim
+
+		err := json.Unmarshal(value, &c)
+
+		if err != nil { return false, errors.New("Corrupt warranty claim " + key) }
+
+		claims = append(claims, c)
+		return true, nil
+	})
+
+	if err != nil { return nil, err }
+
+	if view == VIEW_FULL { return json.Marshal(claims) }
+
+	summaries := []ClaimSummary{}
+
+	for _, c := range claims { summaries = append(summaries, ClaimSummary{ID: c.ID, IMEI: c.IMEI, Status: c.Status, Redacted: true}) }
+
+	return json.Marshal(summaries)
+}
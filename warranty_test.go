@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func (l *test_ledger) warranty(imei string, date ...string) WarrantyStatus {
+	l.t.Helper()
+	var s WarrantyStatus
+	if err := json.Unmarshal([]byte(l.must("check_warranty", append([]string{imei}, date...)...)), &s); err != nil { l.t.Fatal(err) }
+	return s
+}
+
+func (l *test_ledger) claim(imei string, faults string) WarrantyClaim {
+	l.t.Helper()
+	var c WarrantyClaim
+	if err := json.Unmarshal([]byte(l.as(STORE).for_customer("cust-42").must("file_warranty_claim", imei, faults)), &c); err != nil { l.t.Fatal(err) }
+	return c
+}
+
+func TestWarranty(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.as(STORE).fails(ERR_PERMISSION_DENIED, "set_warranty_policy", "VIBE", "24")
+	l.as(VENDOR).fails(ERR_VALIDATION_FAILED, "set_warranty_policy", "VIBE", "0")
+	l.must("set_warranty_policy", "VIBE", "24")
+
+	sold, unsold := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:5], sold)
+
+	d := l.device(sold)
+	if !d.WarrantyExpires.Equal(d.DateOfSale.AddDate(2, 0, 0)) { t.Errorf("warranty not taken from the policy: %+v", d) }
+
+	if s := l.warranty(sold); !s.UnderWarranty || !s.Expires.Equal(d.WarrantyExpires.Time) { t.Errorf("sold device %+v", s) }
+	if s := l.warranty(sold, d.DateOfSale.AddDate(2, 1, 0).Format("2006-01-02")); s.UnderWarranty { t.Errorf("after expiry %+v", s) }
+	if s := l.warranty(sold, "2016-12-03"); s.UnderWarranty { t.Errorf("before the sale %+v", s) }
+	if s := l.warranty(unsold); s.UnderWarranty { t.Errorf("unsold device %+v", s) }
+
+	l.fails(ERR_VALIDATION_FAILED, "check_warranty", sold, "someday")
+}
+
+func TestWarrantyClaims(t *testing.T) {
+
+	l := new_test_ledger(t)
+	imei := l.create(1)
+	l.run_steps(to_vendor_and_back[:5], imei)
+
+	l.as(STORE).for_customer("cust-7").fails(ERR_PERMISSION_DENIED, "file_warranty_claim", imei, `["BATTERY"]`)
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "file_warranty_claim", imei, `["GREMLINS"]`)
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "file_warranty_claim", imei, `[]`)
+
+	c := l.claim(imei, `["battery"]`)
+	if c.Status != CLAIM_OPEN || c.FaultCodes[0] != "BATTERY" || l.device(imei).Claim != c.ID { t.Fatalf("claim %+v", c) }
+
+	l.for_customer("cust-42").fails(ERR_ALREADY_EXISTS, "file_warranty_claim", imei, `["DISPLAY"]`)
+
+	l.fails(ERR_PERMISSION_DENIED, "update_warranty_claim", imei, c.ID, CLAIM_APPROVED)
+	l.as(VENDOR).fails(ERR_VALIDATION_FAILED, "update_warranty_claim", imei, c.ID, CLAIM_REPAIRED)
+	l.fails(ERR_VALIDATION_FAILED, "update_warranty_claim", imei, c.ID, CLAIM_REPLACED)
+	l.fails(ERR_NOT_FOUND, "update_warranty_claim", imei, "nope", CLAIM_APPROVED)
+	l.must("update_warranty_claim", imei, c.ID, CLAIM_APPROVED, "battery swap")
+	l.must("update_warranty_claim", imei, c.ID, CLAIM_REPAIRED)
+
+	if d := l.device(imei); d.Claim != "" { t.Errorf("repaired claim still open on %+v", d) }
+
+	// damage is not covered
+	c = l.claim(imei, `["LIQUID_DAMAGE"]`)
+	l.as(VENDOR).fails(ERR_VALIDATION_FAILED, "update_warranty_claim", imei, c.ID, CLAIM_APPROVED)
+	l.must("update_warranty_claim", imei, c.ID, CLAIM_REJECTED, "water indicator tripped")
+
+	var claims []WarrantyClaim
+	if err := json.Unmarshal([]byte(l.must("get_warranty_claims", imei)), &claims); err != nil || len(claims) != 2 { t.Fatalf("claims %v", claims) }
+	statuses := map[string]bool{claims[0].Status: true, claims[1].Status: true}
+	if !statuses[CLAIM_REPAIRED] || !statuses[CLAIM_REJECTED] { t.Errorf("claims %+v", claims) }
+}
+
+func TestWarrantyReplacement(t *testing.T) {
+
+	l := new_test_ledger(t)
+	old, replacement := l.create(1), l.create(2)
+	l.run_steps(to_vendor_and_back[:5], old)
+	l.run_steps(to_vendor_and_back[:4], replacement)
+
+	c := l.claim(old, `["DISPLAY"]`)
+	l.as(STORE).for_customer("cust-42").must("RTN_FROM_CUST", old, STORE)
+
+	// the claim has to be decided before the device can be replaced
+	l.for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", replacement, old)
+	l.as(VENDOR).must("update_warranty_claim", old, c.ID, CLAIM_APPROVED)
+
+	// long after the exchange window has closed
+	d := l.device(old)
+	d.DateOfSale = LedgerTime{d.DateOfSale.AddDate(0, -6, 0)}
+	l.begin()
+	if _, err := l.cc.save_changes(l.stub, d); err != nil { t.Fatal(err) }
+	l.end()
+
+	l.as(STORE).for_customer("cust-42").fails(ERR_VALIDATION_FAILED, "EXCHANGE_DEV", replacement, old, EXCHANGE_UPGRADE, "10")
+	l.for_customer("cust-42").must("EXCHANGE_DEV", replacement, old)
+
+	n := l.device(replacement)
+	if !n.WarrantyExpires.Equal(d.WarrantyExpires.Time) { t.Errorf("replacement warranty %s, expected %s", n.WarrantyExpires, d.WarrantyExpires) }
+	if s := l.warranty(old); s.UnderWarranty || s.Claim != "" { t.Errorf("returned device still covered: %+v", s) }
+
+	var claims []WarrantyClaim
+	if err := json.Unmarshal([]byte(l.must("get_warranty_claims", old)), &claims); err != nil || len(claims) != 1 { t.Fatal(claims) }
+	if claims[0].Status != CLAIM_REPLACED || claims[0].Replacement != replacement { t.Errorf("claim %+v", claims[0]) }
+}